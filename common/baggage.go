@@ -0,0 +1,29 @@
+package common
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+const TenantBaggageKey = "tenant.id"
+
+// ContextWithTenant adds the tenant id to the request baggage so it is
+// propagated to downstream services. Baggage is sent in the headers of every
+// outgoing request and the W3C spec limits it to 8192 bytes in total, so only
+// short identifiers should be stored in it.
+func ContextWithTenant(ctx context.Context, tenantID string) (context.Context, error) {
+	member, err := baggage.NewMemberRaw(TenantBaggageKey, tenantID)
+	if err != nil {
+		return ctx, err
+	}
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx, err
+	}
+	return baggage.ContextWithBaggage(ctx, bag), nil
+}
+
+func TenantFromContext(ctx context.Context) string {
+	return baggage.FromContext(ctx).Member(TenantBaggageKey).Value()
+}
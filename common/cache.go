@@ -0,0 +1,118 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type cacheEntry[V any] struct {
+	value     V
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+// TTLCache is an in-memory cache safe for concurrent use, whose entries
+// expire after the ttl and are evicted lazily when read
+type TTLCache[V any] struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[string]cacheEntry[V]
+}
+
+func NewTTLCache[V any](ttl time.Duration) *TTLCache[V] {
+	return &TTLCache[V]{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry[V]),
+	}
+}
+
+func (c *TTLCache[V]) TTL() time.Duration {
+	return c.ttl
+}
+
+func (c *TTLCache[V]) Get(key string) (V, bool) {
+	value, _, ok, _ := c.lookup(key)
+	return value, ok
+}
+
+// GetContext is Get adding to the span in ctx a "cache.hit", "cache.miss" or
+// "cache.evict.stale" event with the key and the age of the entry
+func (c *TTLCache[V]) GetContext(ctx context.Context, key string) (V, bool) {
+	value, age, ok, evicted := c.lookup(key)
+	span := trace.SpanFromContext(ctx)
+	switch {
+	case ok:
+		span.AddEvent("cache.hit", trace.WithAttributes(
+			attribute.String("cache.key", key),
+			attribute.Int64("cache.age_ms", age.Milliseconds()),
+		))
+	case evicted:
+		span.AddEvent("cache.evict.stale", trace.WithAttributes(
+			attribute.String("cache.key", key),
+			attribute.Int64("cache.age_ms", age.Milliseconds()),
+		))
+		fallthrough
+	default:
+		span.AddEvent("cache.miss", trace.WithAttributes(attribute.String("cache.key", key)))
+	}
+	return value, ok
+}
+
+// lookup returns the value and its age, evicted tells an expired entry was removed
+func (c *TTLCache[V]) lookup(key string) (value V, age time.Duration, ok bool, evicted bool) {
+	c.mu.RLock()
+	entry, found := c.entries[key]
+	c.mu.RUnlock()
+	if !found {
+		return value, 0, false, false
+	}
+	now := time.Now()
+	if now.After(entry.expiresAt) {
+		c.mu.Lock()
+		// re-check under the write lock, another request may have refreshed it
+		if current, ok := c.entries[key]; ok && now.After(current.expiresAt) {
+			delete(c.entries, key)
+			evicted = true
+		}
+		c.mu.Unlock()
+		return value, now.Sub(entry.storedAt), false, evicted
+	}
+	return entry.value, now.Sub(entry.storedAt), true, false
+}
+
+// DeleteExpired removes the expired entries, for the caches whose keys are
+// rarely read again and so are never evicted by lookup
+func (c *TTLCache[V]) DeleteExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	deleted := 0
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (c *TTLCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.entries[key] = cacheEntry[V]{
+		value:     value,
+		storedAt:  now,
+		expiresAt: now.Add(c.ttl),
+	}
+}
+
+// SetContext is Set adding a "cache.store" event to the span in ctx
+func (c *TTLCache[V]) SetContext(ctx context.Context, key string, value V) {
+	c.Set(key, value)
+	trace.SpanFromContext(ctx).AddEvent("cache.store", trace.WithAttributes(attribute.String("cache.key", key)))
+}
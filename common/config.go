@@ -0,0 +1,43 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// LoadConfigFile reads the optional config file, for local runs: the file in
+// CONFIG_FILE when set, otherwise config.yaml (or .json, .toml, ...) or .env in
+// the working directory. Flags and env vars keep precedence over the file. It
+// returns the file read, empty when there is none.
+func LoadConfigFile() (string, error) {
+	if file := viper.GetString("CONFIG_FILE"); file != "" {
+		viper.SetConfigFile(file)
+		if err := viper.ReadInConfig(); err != nil {
+			return "", fmt.Errorf("failed to read config file %s: %w", file, err)
+		}
+		return file, nil
+	}
+
+	viper.SetConfigName("config")
+	viper.AddConfigPath(".")
+	err := viper.ReadInConfig()
+	if err == nil {
+		return viper.ConfigFileUsed(), nil
+	}
+	if !errors.As(err, &viper.ConfigFileNotFoundError{}) {
+		return "", fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// sem config.*, tenta o .env
+	if _, err := os.Stat(".env"); err != nil {
+		return "", nil
+	}
+	viper.SetConfigFile(".env")
+	if err := viper.ReadInConfig(); err != nil {
+		return "", fmt.Errorf("failed to read config file .env: %w", err)
+	}
+	return ".env", nil
+}
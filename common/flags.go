@@ -0,0 +1,40 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Flag is a command line flag bound to the viper key of an env var, like
+// --port to PORT
+type Flag struct {
+	Name  string
+	Key   string
+	Usage string
+}
+
+// ParseFlags parses the command line and binds the flags to viper, so the
+// precedence is flag, then env var, then the default set in viper. A parse
+// error was already printed with the usage, --help returns pflag.ErrHelp
+func ParseFlags(name string, args []string, flags []Flag) error {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	for _, f := range flags {
+		fs.String(f.Name, "", fmt.Sprintf("%s (env %s)", f.Usage, f.Key))
+	}
+	if err := fs.Parse(args); err != nil {
+		if !errors.Is(err, pflag.ErrHelp) { // o --help já imprimiu o uso
+			fmt.Fprintln(fs.Output(), err)
+			fs.PrintDefaults()
+		}
+		return err
+	}
+	for _, f := range flags {
+		if err := viper.BindPFlag(f.Key, fs.Lookup(f.Name)); err != nil {
+			return fmt.Errorf("failed to bind flag %q: %w", f.Name, err)
+		}
+	}
+	return nil
+}
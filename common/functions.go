@@ -1,8 +1,126 @@
 package common
 
-import "regexp"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
 
+var (
+	ErrInvalidCEP    = errors.New("invalid zipcode")
+	ErrCEPNotAllowed = errors.New("zipcode outside the allowed region")
+	ErrInvalidUnits  = errors.New("invalid units, use c, f, k or all")
+	ErrInvalidDetail = errors.New("invalid detail, use full")
+)
+
+var hyphenatedCEP = regexp.MustCompile(`^(\d{5})-?(\d{3})$`)
+
+// IsValidCEP tells whether cep is already in the 8 digit form returned by
+// NormalizeCEP, which is the only form put in the ViaCEP URL
 func IsValidCEP(cep string) bool {
-	re := regexp.MustCompile(`^\d{8}$`)
-	return re.MatchString(cep)
+	return postalCodeValidators[CountryBR].IsValid(cep)
+}
+
+// NormalizeCEP accepts a CEP with surrounding whitespace and an optional
+// hyphen ("01310-100") and returns its clean 8 digit form ("01310100")
+func NormalizeCEP(cep string) (string, error) {
+	return postalCodeValidators[CountryBR].Normalize(cep)
+}
+
+// CEPPrefixes parses a comma separated list of CEP prefixes, like "01,20040"
+func CEPPrefixes(list string) []string {
+	return SplitList(list)
+}
+
+// SplitList parses a comma separated list, dropping the blanks around and
+// between the items
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// CEPInAllowedRange tells whether the normalized cep starts with one of the
+// prefixes, with no prefixes every cep is allowed
+func CEPInAllowedRange(cep string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(cep, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseUnits validates the units query param, c, f, k or all, defaulting to
+// all when empty
+func ParseUnits(units string) (string, error) {
+	switch units = strings.ToLower(strings.TrimSpace(units)); units {
+	case "":
+		return UnitsAll, nil
+	case UnitsCelsius, UnitsFahrenheit, UnitsKelvin, UnitsAll:
+		return units, nil
+	default:
+		return "", ErrInvalidUnits
+	}
+}
+
+// DetailFull asks for the neighborhood and the street of the CEP besides the city
+const DetailFull = "full"
+
+// ParseDetail validates the detail query param, empty for the city only or
+// DetailFull
+func ParseDetail(detail string) (string, error) {
+	switch detail = strings.ToLower(strings.TrimSpace(detail)); detail {
+	case "", DetailFull:
+		return detail, nil
+	default:
+		return "", ErrInvalidDetail
+	}
+}
+
+// ListenAddr validates a TCP port and returns the address to bind to
+func ListenAddr(port string) (string, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q: must be a number between 1 and 65535", port)
+	}
+	return ":" + strconv.Itoa(n), nil
+}
+
+// BaseURL validates an absolute http(s) URL read from the env var name and
+// returns it without the trailing slash, so paths can be appended to it
+func BaseURL(name, raw string) (string, error) {
+	if raw == "" {
+		return "", fmt.Errorf("%s not set", name)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %w", name, raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid %s %q: must be an absolute http or https URL, like http://service_b:8080", name, raw)
+	}
+	return strings.TrimSuffix(raw, "/"), nil
+}
+
+// Round1 rounds to one decimal place, half away from zero. The tolerance
+// makes values like 1.45, stored as 1.4499999..., round up as written
+func Round1(v float64) float64 {
+	return math.Round(v*10+math.Copysign(1e-9, v)) / 10
+}
+
+// ConvertTemperature converts a temperature in Celsius to Fahrenheit and Kelvin
+func ConvertTemperature(celsius float64) (f, k float64) {
+	return celsius*1.8 + 32, celsius + 273.15
 }
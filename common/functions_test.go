@@ -0,0 +1,75 @@
+package common
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func FuzzNormalizeCEP(f *testing.F) {
+	for _, seed := range []string{
+		"01310100", "01310-100", " 01310-100\n", "0131010", "013101000", "01310--100",
+		"", "abcdefgh", "../../etc", "01310%2F100", "01310100?x=1", "٠١٣١٠١٠٠", "01310/100",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		cep, err := NormalizeCEP(raw)
+		if valid := IsValidCEP(cep); valid != (err == nil) {
+			t.Fatalf("NormalizeCEP(%q) = %q, %v but IsValidCEP = %v", raw, cep, err, valid)
+		}
+		if err != nil {
+			if cep != "" {
+				t.Fatalf("NormalizeCEP(%q) = %q with error %v, want an empty cep", raw, cep, err)
+			}
+			return
+		}
+		if len(cep) != 8 || strings.Trim(cep, "0123456789") != "" {
+			t.Fatalf("NormalizeCEP(%q) = %q, want 8 ASCII digits", raw, cep)
+		}
+		if again, err := NormalizeCEP(cep); err != nil || again != cep {
+			t.Fatalf("NormalizeCEP(%q) = %q, %v, want it idempotent", cep, again, err)
+		}
+	})
+}
+
+func TestConvertTemperature(t *testing.T) {
+	tests := []struct {
+		celsius, wantF, wantK float64
+	}{
+		{0, 32, 273.15},
+		{100, 212, 373.15},
+		{-40, -40, 233.15},
+		{-273.15, -459.67, 0},
+	}
+	for _, tt := range tests {
+		f, k := ConvertTemperature(tt.celsius)
+		if math.Abs(f-tt.wantF) > 1e-9 || math.Abs(k-tt.wantK) > 1e-9 {
+			t.Errorf("ConvertTemperature(%v) = %v °F, %v K, want %v °F, %v K", tt.celsius, f, k, tt.wantF, tt.wantK)
+		}
+	}
+}
+
+func TestRound1(t *testing.T) {
+	tests := []struct {
+		in, want float64
+	}{
+		{0.05, 0.1},
+		{0.15, 0.2},
+		{1.45, 1.5},
+		{2.25, 2.3},
+		{298.15, 298.2},
+		{1.04, 1.0},
+		{-0.05, -0.1},
+		{-0.15, -0.2},
+		{-1.45, -1.5},
+		{-2.25, -2.3},
+		{-1.04, -1.0},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if got := Round1(tt.in); got != tt.want {
+			t.Errorf("Round1(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// HealthHandler is the liveness probe, it answers 200 as long as the process
+// is able to serve requests
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	WriteHealth(w, http.StatusOK, "")
+}
+
+func WriteHealth(w http.ResponseWriter, code int, reason string) {
+	status := "ok"
+	if code != http.StatusOK {
+		status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(HealthResponse{Status: status, Reason: reason})
+}
+
+// WriteJSONError answers status with an ErrorResponse body, code is a stable
+// identifier for clients and message the human readable description
+func WriteJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// CheckReachable does a GET to url and fails unless it answers with a non 5xx status
+func CheckReachable(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status %d from %s", res.StatusCode, url)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// HTTPPool tunes the idle connections kept for reuse, the calls go always to
+// the same few hosts so keeping them avoids a new TCP and TLS handshake
+type HTTPPool struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// DefaultHTTPPool is the pool used when none is configured
+var DefaultHTTPPool = HTTPPool{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// NewHTTPClient builds the client for the outbound calls: the otelhttp
+// transport creates a client span and injects the trace context, and the
+// timeout bounds both the connection and the whole request so a hung upstream
+// can't block a request
+func NewHTTPClient(timeout time.Duration, userAgent string, pool HTTPPool) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: otelhttp.NewTransport(NewHTTPTransport(timeout, userAgent, pool)),
+	}
+}
+
+// NewHTTPTransport is the tuned transport of NewHTTPClient without the
+// tracing, for the probes and health checks that shouldn't create spans
+func NewHTTPTransport(timeout time.Duration, userAgent string, pool HTTPPool) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = timeout
+	transport.MaxIdleConns = pool.MaxIdleConns
+	transport.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = pool.IdleConnTimeout
+	return UserAgentTransport(transport, userAgent)
+}
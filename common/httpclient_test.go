@@ -0,0 +1,70 @@
+package common
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer counts the connections opened to it, one per dial of the client
+func countingServer(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	var dials atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.Start()
+	tb.Cleanup(server.Close)
+	return server, &dials
+}
+
+func get(tb testing.TB, client *http.Client, url string) {
+	res, err := client.Get(url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// o corpo lido até o fim devolve a conexão para o pool
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+func TestNewHTTPClientReusesConnections(t *testing.T) {
+	server, dials := countingServer(t)
+	client := NewHTTPClient(time.Second, "test", DefaultHTTPPool)
+	for range 20 {
+		get(t, client, server.URL)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("%d connections for 20 sequential requests, want 1", n)
+	}
+}
+
+func BenchmarkHTTPClientDials(b *testing.B) {
+	pools := []struct {
+		name string
+		pool HTTPPool
+	}{
+		{"pooled", DefaultHTTPPool},
+		// um limite negativo não guarda nenhuma conexão ociosa
+		{"no idle connections", HTTPPool{MaxIdleConns: 100, MaxIdleConnsPerHost: -1, IdleConnTimeout: 90 * time.Second}},
+	}
+	for _, p := range pools {
+		b.Run(p.name, func(b *testing.B) {
+			server, dials := countingServer(b)
+			client := NewHTTPClient(time.Second, "test", p.pool)
+			b.ResetTimer()
+			for range b.N {
+				get(b, client, server.URL)
+			}
+			b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// InFlight counts the requests being served, so the shutdown can tell how
+// much work it is waiting for
+type InFlight struct {
+	n atomic.Int64
+}
+
+func (f *InFlight) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.n.Add(1)
+		defer f.n.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *InFlight) Count() int64 {
+	return f.n.Load()
+}
+
+// DrainServer shuts srv down waiting for the in-flight requests until ctx
+// expires, logging how many there were and whether the drain completed
+func DrainServer(ctx context.Context, srv *http.Server, inFlight *InFlight, logger *slog.Logger) {
+	start := time.Now()
+	logger.Info("draining in-flight requests", slog.Int64("in_flight", inFlight.Count()))
+	err := srv.Shutdown(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Warn("drain timed out, requests were abandoned",
+			slog.Int64("in_flight", inFlight.Count()),
+			slog.Duration("waited", time.Since(start)),
+		)
+	case err != nil:
+		logger.Error("failed to shutdown HTTP server", slog.Any("error", err))
+	default:
+		logger.Info("drain completed", slog.Duration("waited", time.Since(start)))
+	}
+}
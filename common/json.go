@@ -0,0 +1,55 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DecodeJSON decodes the request body into v in a "decode request" span, so
+// the trace shows the serialization cost
+func DecodeJSON(ctx context.Context, tracer trace.Tracer, body io.Reader, v any) error {
+	_, span := tracer.Start(ctx, "decode request")
+	defer span.End()
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// EncodeJSON writes v as the JSON response in an "encode response" span. The
+// status was already sent, so the error is only returned for callers that
+// need to stop writing, TracingAndMetrics passes it to RecordResponseError.
+func EncodeJSON(ctx context.Context, tracer trace.Tracer, w http.ResponseWriter, v any) error {
+	_, span := tracer.Start(ctx, "encode response")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil { // o cliente pode ter desconectado
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// RecordResponseError logs err and marks the request span in ctx as failed
+// when writing the response body failed, the client got a truncated body with
+// the status of a success so only the span and the log tell
+func RecordResponseError(ctx context.Context, err error, attrs ...slog.Attr) {
+	if err == nil {
+		return
+	}
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "failed to write response")
+	// o status já foi enviado, o cliente recebeu um corpo truncado
+	LoggerFromContext(ctx).LogAttrs(ctx, slog.LevelError, "failed to write response",
+		append([]slog.Attr{slog.String("error", err.Error())}, attrs...)...)
+}
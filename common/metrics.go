@@ -0,0 +1,104 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// InitMetricsProvider mirrors InitProvider for metrics, exporting them to the
+// collector over OTLP. Without a collector URL metrics are disabled and the
+// global no-op meter provider is kept.
+func InitMetricsProvider(cfg ProviderConfig) (func(context.Context) error, error) {
+	ctx := context.Background()
+
+	if cfg.Disabled || cfg.CollectorURL == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := newResource(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	metricExporter, err := newMetricExporter(ctx, cfg.Protocol, cfg.CollectorURL)
+	if err != nil {
+		return nil, err
+	}
+
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+	)
+	otel.SetMeterProvider(meterProvider)
+
+	return meterProvider.Shutdown, nil
+}
+
+func newMetricExporter(ctx context.Context, protocol, collectorURL string) (sdkmetric.Exporter, error) {
+	var (
+		metricExporter sdkmetric.Exporter
+		err            error
+	)
+	switch protocol {
+	case "", ProtocolGRPC:
+		metricExporter, err = otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithEndpoint(collectorURL),
+			otlpmetricgrpc.WithInsecure(),
+		)
+	case ProtocolHTTPProtobuf:
+		metricExporter, err = otlpmetrichttp.New(ctx,
+			otlpmetrichttp.WithEndpoint(collectorURL),
+			otlpmetrichttp.WithInsecure(),
+		)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric exporter: %w", err)
+	}
+	return metricExporter, nil
+}
+
+// requestInstruments are the request counter and latency histogram recorded
+// by TracingAndMetrics
+type requestInstruments struct {
+	requests metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+func newRequestInstruments(meter metric.Meter) requestInstruments {
+	requests, err := meter.Int64Counter("service.requests",
+		metric.WithDescription("Number of handled requests."),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	duration, err := meter.Float64Histogram("service.request.duration",
+		metric.WithDescription("Duration of the handled requests."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	return requestInstruments{requests: requests, duration: duration}
+}
+
+func (i requestInstruments) record(ctx context.Context, route string, status int, elapsed time.Duration) {
+	attrs := metric.WithAttributes(
+		attribute.String("http.route", route),
+		attribute.Int("http.response.status_code", status),
+	)
+	i.requests.Add(ctx, 1, attrs)
+	i.duration.Record(ctx, elapsed.Seconds(), attrs)
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	CountryBR = "br"
+	CountryPT = "pt"
+)
+
+// PostalCodeValidator validates and normalizes the postal codes of a country,
+// the BR CEP "01310-100" becomes "01310100" and the PT "1000-001" keeps its hyphen
+type PostalCodeValidator struct {
+	Country string
+	pattern *regexp.Regexp
+	format  string // junta os dois grupos do pattern na forma normalizada
+}
+
+var postalCodeValidators = map[string]PostalCodeValidator{
+	CountryBR: {Country: CountryBR, pattern: hyphenatedCEP, format: "%s%s"},
+	CountryPT: {Country: CountryPT, pattern: regexp.MustCompile(`^(\d{4})-?(\d{3})$`), format: "%s-%s"},
+}
+
+// NewPostalCodeValidator returns the validator of the country, like "br" or
+// "pt", an empty country is "br"
+func NewPostalCodeValidator(country string) (PostalCodeValidator, error) {
+	country = strings.ToLower(strings.TrimSpace(country))
+	if country == "" {
+		country = CountryBR
+	}
+	v, ok := postalCodeValidators[country]
+	if !ok {
+		return PostalCodeValidator{}, fmt.Errorf("unsupported country %q", country)
+	}
+	return v, nil
+}
+
+// Normalize accepts the code with surrounding whitespace and an optional
+// hyphen and returns its normalized form
+func (v PostalCodeValidator) Normalize(code string) (string, error) {
+	m := v.pattern.FindStringSubmatch(strings.TrimSpace(code))
+	if m == nil {
+		return "", ErrInvalidCEP
+	}
+	return fmt.Sprintf(v.format, m[1], m[2]), nil
+}
+
+// IsValid tells whether the code is already in its normalized form
+func (v PostalCodeValidator) IsValid(code string) bool {
+	normalized, err := v.Normalize(code)
+	return err == nil && normalized == code
+}
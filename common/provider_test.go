@@ -0,0 +1,139 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+// keptSpans is an InMemoryExporter that keeps the spans after the shutdown,
+// the in-memory one resets them there
+type keptSpans struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpans) Shutdown(context.Context) error { return nil }
+
+// restoreOtel puts back the global tracer provider and propagator InitProvider replaces
+func restoreOtel(t *testing.T) {
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+}
+
+func TestInitProviderExportsSpans(t *testing.T) {
+	restoreOtel(t)
+	exporter := keptSpans{tracetest.NewInMemoryExporter()}
+	shutdown, err := InitProvider(ProviderConfig{ServiceName: "service_test", ServiceVersion: "1.2.3", SpanExporter: exporter})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "lookup")
+	span.End()
+
+	// o batch processor só exporta no shutdown, que precisa esvaziar a fila
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown() = %v", err)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "lookup" {
+		t.Fatalf("exported spans = %v, want the lookup span", spans.Snapshots())
+	}
+	attrs := map[string]string{}
+	for _, kv := range spans[0].Resource.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs[string(semconv.ServiceNameKey)] != "service_test" || attrs[string(semconv.ServiceVersionKey)] != "1.2.3" {
+		t.Errorf("resource = %v, want the service name and version", attrs)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("second shutdown() = %v, want nil", err)
+	}
+}
+
+func TestInitProviderSamplingRatio(t *testing.T) {
+	ratio := func(r float64) *float64 { return &r }
+	tests := []struct {
+		name      string
+		ratio     *float64
+		wantSpans int
+	}{
+		{"unset samples every trace", nil, 1},
+		{"ratio 1", ratio(1), 1},
+		{"ratio 0", ratio(0), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restoreOtel(t)
+			exporter := keptSpans{tracetest.NewInMemoryExporter()}
+			shutdown, err := InitProvider(ProviderConfig{ServiceName: "service_test", SamplingRatio: tt.ratio, SpanExporter: exporter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, span := otel.Tracer("test").Start(context.Background(), "lookup")
+			span.End()
+			if err := shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if spans := exporter.GetSpans(); len(spans) != tt.wantSpans {
+				t.Errorf("exported %d spans, want %d", len(spans), tt.wantSpans)
+			}
+		})
+	}
+}
+
+func TestInitProviderRejectsInvalidRatio(t *testing.T) {
+	restoreOtel(t)
+	ratio := 1.5
+	if _, err := InitProvider(ProviderConfig{ServiceName: "service_test", SamplingRatio: &ratio}); err == nil {
+		t.Error("InitProvider() accepted the ratio 1.5")
+	}
+}
+
+func TestInitProviderDisabled(t *testing.T) {
+	restoreOtel(t)
+	exporter := keptSpans{tracetest.NewInMemoryExporter()}
+	// o coletor não existe, desabilitado nada deve tentar conectar nele
+	cfg := ProviderConfig{ServiceName: "service_test", Exporter: ExporterOTLP, CollectorURL: "127.0.0.1:1", SpanExporter: exporter, Disabled: true}
+	shutdown, err := InitProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdownMetrics, err := InitMetricsProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(http.Header{"Traceparent": {traceparent}}))
+	ctx, span := otel.Tracer("test").Start(ctx, "lookup")
+	if span.IsRecording() {
+		t.Error("span is recording with the SDK disabled")
+	}
+	// o contexto recebido continua sendo propagado para o próximo serviço
+	outgoing := http.Header{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(outgoing))
+	if got := outgoing.Get("Traceparent"); got != traceparent {
+		t.Errorf("propagated traceparent = %q, want %q", got, traceparent)
+	}
+	span.End()
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() = %v", err)
+	}
+	if err := shutdownMetrics(context.Background()); err != nil {
+		t.Errorf("metrics shutdown() = %v", err)
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("exported %d spans with the SDK disabled, want none", len(spans))
+	}
+}
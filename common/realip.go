@@ -0,0 +1,98 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or single IPs,
+// like "10.0.0.0/8,::1", an empty list trusts no proxy
+func ParseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// RealIP replaces the remote address of the request with the client IP, like
+// chi's middleware.RealIP, but only honors X-Forwarded-For and X-Real-IP when
+// the connection comes from one of the trusted proxies, so clients can't
+// spoof their address
+func RealIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip, ok := clientIP(r, trusted); ok {
+				r.RemoteAddr = ip.String()
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func clientIP(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	remote, ok := parseIP(r.RemoteAddr)
+	if !ok || !isTrusted(remote, trusted) {
+		return remote, ok
+	}
+
+	// o X-Forwarded-For é lido da direita para a esquerda, o primeiro endereço
+	// que não é de um proxy confiável é o do cliente
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseIP(hops[i])
+		if !ok {
+			break
+		}
+		if !isTrusted(hop, trusted) {
+			return hop, true
+		}
+		remote = hop
+	}
+	if realIP, ok := parseIP(r.Header.Get("X-Real-IP")); ok && r.Header.Get("X-Forwarded-For") == "" {
+		return realIP, true
+	}
+	return remote, true
+}
+
+// parseIP accepts an address with or without port, including the bracketed
+// IPv6 form "[::1]:8000"
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
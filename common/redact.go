@@ -0,0 +1,68 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+// query parameters that carry credentials, like the weatherapi key
+var sensitiveParams = []string{"key", "apikey", "api_key", "token"}
+
+// RedactURL masks the query parameters that carry credentials, so the URL can
+// be recorded in spans, errors and logs
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	query := u.Query()
+	redacted := false
+	for _, name := range sensitiveParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return raw
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// RedactError masks the credentials in the URL carried by the errors returned
+// by net/http, which include the full request URL in their message
+func RedactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = RedactURL(urlErr.URL)
+	}
+	return err
+}
+
+// redactingProcessor rewrites the URL attributes set by the otelhttp
+// instrumentation when the span starts, before any exporter can see them
+type redactingProcessor struct{}
+
+var urlAttributes = []attribute.Key{"url.full", semconv.HTTPURLKey}
+
+func (redactingProcessor) OnStart(_ context.Context, s sdktrace.ReadWriteSpan) {
+	for _, attr := range s.Attributes() {
+		for _, key := range urlAttributes {
+			if attr.Key == key {
+				s.SetAttributes(key.String(RedactURL(attr.Value.AsString())))
+			}
+		}
+	}
+}
+
+func (redactingProcessor) OnEnd(sdktrace.ReadOnlySpan) {}
+
+func (redactingProcessor) Shutdown(context.Context) error { return nil }
+
+func (redactingProcessor) ForceFlush(context.Context) error { return nil }
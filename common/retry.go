@@ -0,0 +1,91 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy bounds the attempts of DoWithRetry
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt, below 1 means a single attempt
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubled on each retry
+	BaseDelay time.Duration
+}
+
+// clock is the time source of DoWithRetry, replaced in the tests so the
+// backoffs don't have to be waited for
+type clock struct {
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+var retryClock = clock{now: time.Now, sleep: sleepContext}
+
+// sleepContext waits for d, returning early with the ctx error when it ends
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Validate rejects a negative BaseDelay, which has no meaning as a backoff
+func (p RetryPolicy) Validate() error {
+	if p.BaseDelay < 0 {
+		return fmt.Errorf("invalid retry base delay %v: must not be negative", p.BaseDelay)
+	}
+	return nil
+}
+
+// Backoff returns the delay after the given attempt, doubling the base delay
+// on each attempt and adding up to 50% of random jitter
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay>>(attempt-1) != p.BaseDelay { // o deslocamento estourou
+		delay = math.MaxInt64 / 2
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// DoWithRetry calls fn, numbering the attempts from 1, until it succeeds, it
+// answers that the error is not worth a retry or the attempts run out. The ctx
+// is checked before each attempt, and when the next backoff would end after
+// the ctx deadline the last error is returned right away instead of waiting.
+// An invalid policy fails before the first attempt.
+func DoWithRetry(ctx context.Context, fn func(ctx context.Context, attempt int) (retry bool, err error), policy RetryPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	var lastErr error
+	for attempt := 1; attempt <= max(policy.MaxAttempts, 1); attempt++ {
+		if attempt > 1 {
+			delay := policy.Backoff(attempt - 1)
+			if deadline, ok := ctx.Deadline(); ok && deadline.Sub(retryClock.now()) < delay {
+				return lastErr // não há tempo para outra tentativa
+			}
+			if err := retryClock.sleep(ctx, delay); err != nil {
+				return err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		retry, err := fn(ctx, attempt)
+		if err == nil || !retry {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock advances the time on each sleep instead of waiting
+type fakeClock struct {
+	current time.Time
+	slept   []time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.current }
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	c.slept = append(c.slept, d)
+	c.current = c.current.Add(d)
+	return ctx.Err()
+}
+
+// useFakeClock replaces the clock of DoWithRetry for the test, starting at
+// the real time since the ctx deadlines still expire on the real clock
+func useFakeClock(t *testing.T) *fakeClock {
+	fake := &fakeClock{current: time.Now()}
+	previous := retryClock
+	retryClock = clock{now: fake.now, sleep: fake.sleep}
+	t.Cleanup(func() { retryClock = previous })
+	return fake
+}
+
+var errUpstream = errors.New("connection refused")
+
+func TestDoWithRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       RetryPolicy
+		budget       time.Duration // 0 é sem prazo
+		retry        bool
+		wantAttempts int
+		wantSleeps   int
+	}{
+		{"retries until the attempts run out", RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond}, 0, true, 3, 2},
+		{"stops when the next backoff passes the deadline", RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond}, 500 * time.Millisecond, true, 3, 2},
+		{"does not retry a non retryable error", RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond}, 0, false, 1, 0},
+		{"single attempt below 1", RetryPolicy{MaxAttempts: 0}, 0, true, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			ctx := context.Background()
+			if tt.budget > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, fake.current.Add(tt.budget))
+				defer cancel()
+			}
+
+			attempts := 0
+			err := DoWithRetry(ctx, func(ctx context.Context, attempt int) (bool, error) {
+				attempts++
+				if attempt != attempts {
+					t.Errorf("attempt = %d, want %d", attempt, attempts)
+				}
+				return tt.retry, errUpstream
+			}, tt.policy)
+
+			if !errors.Is(err, errUpstream) {
+				t.Errorf("DoWithRetry() = %v, want the last error", err)
+			}
+			if attempts != tt.wantAttempts || len(fake.slept) != tt.wantSleeps {
+				t.Errorf("attempts = %d sleeps = %v, want %d attempts and %d sleeps", attempts, fake.slept, tt.wantAttempts, tt.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestDoWithRetryRejectsNegativeDelay(t *testing.T) {
+	useFakeClock(t)
+	called := false
+	err := DoWithRetry(context.Background(), func(ctx context.Context, attempt int) (bool, error) {
+		called = true
+		return true, errUpstream
+	}, RetryPolicy{MaxAttempts: 3, BaseDelay: -time.Millisecond})
+	if err == nil || called {
+		t.Errorf("DoWithRetry() = %v, called = %v, want the policy rejected before any attempt", err, called)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond}
+	for attempt, base := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond} {
+		if delay := policy.Backoff(attempt); delay < base || delay > base+base/2 {
+			t.Errorf("Backoff(%d) = %v, want between %v and %v", attempt, delay, base, base+base/2)
+		}
+	}
+	if delay := policy.Backoff(80); delay <= 0 {
+		t.Errorf("Backoff(80) = %v, want the overflow capped", delay)
+	}
+	if delay := (RetryPolicy{}).Backoff(3); delay != 0 {
+		t.Errorf("Backoff without a base delay = %v, want 0", delay)
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DebugTraceHeader forces the request to be sampled, like "X-Debug-Trace: 1"
+const DebugTraceHeader = "X-Debug-Trace"
+
+// debugTraceKey marks the server spans started with the DebugTraceHeader
+const debugTraceKey = attribute.Key("debug.force_sample")
+
+// debugTraceAttributes returns the attribute that forces the sampling when the
+// request carries a true DebugTraceHeader
+func debugTraceAttributes(r *http.Request) []attribute.KeyValue {
+	force, err := strconv.ParseBool(r.Header.Get(DebugTraceHeader))
+	if err != nil || !force {
+		return nil
+	}
+	return []attribute.KeyValue{debugTraceKey.Bool(true)}
+}
+
+// debugSampler samples the spans marked by debugTraceKey whatever the parent
+// and the ratio say, the other spans are decided by the delegate. The sampled
+// flag of the forced span is propagated, so the downstream services sample
+// the rest of the trace through their ParentBased sampler
+type debugSampler struct {
+	delegate sdktrace.Sampler
+}
+
+func (s debugSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key == debugTraceKey && attr.Value.AsBool() {
+			return sdktrace.SamplingResult{
+				Decision:   sdktrace.RecordAndSample,
+				Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+			}
+		}
+	}
+	return s.delegate.ShouldSample(p)
+}
+
+func (s debugSampler) Description() string {
+	return fmt.Sprintf("DebugSampler{%s}", s.delegate.Description())
+}
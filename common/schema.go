@@ -0,0 +1,110 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// SchemaV1 is the flat WeatherResponse, the default
+	SchemaV1 = "v1"
+	// SchemaV2 is the WeatherResponseV2, with the temperatures and the
+	// location nested
+	SchemaV2 = "v2"
+
+	// SchemaVersionHeader tells the schema version of the response
+	SchemaVersionHeader = "X-Schema-Version"
+)
+
+var ErrInvalidSchemaVersion = errors.New("invalid schema version, use v1 or v2")
+
+// acceptVersion matches the vendor media type, like application/vnd.weather.v2+json
+var acceptVersion = regexp.MustCompile(`application/vnd\.weather\.(v\d+)\+json`)
+
+// ParseSchemaVersion selects the response schema from the v query param, like
+// ?v=2, or else from an Accept header like application/vnd.weather.v2+json,
+// defaulting to SchemaV1
+func ParseSchemaVersion(r *http.Request) (string, error) {
+	version := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("v")))
+	if version == "" {
+		if m := acceptVersion.FindStringSubmatch(strings.ToLower(r.Header.Get("Accept"))); m != nil {
+			version = m[1]
+		}
+	}
+	switch strings.TrimPrefix(version, "v") {
+	case "", "1":
+		return SchemaV1, nil
+	case "2":
+		return SchemaV2, nil
+	default:
+		return "", ErrInvalidSchemaVersion
+	}
+}
+
+// WeatherResponseV2 groups the temperatures and the location metadata of the
+// WeatherResponse in their own objects
+type WeatherResponseV2 struct {
+	Cep          string         `json:"cep"`
+	Location     LocationV2     `json:"location"`
+	Temperatures TemperaturesV2 `json:"temperatures"`
+	Source       string         `json:"source,omitempty"`
+	Stale        bool           `json:"stale,omitempty"`
+	RetrievedAt  time.Time      `json:"retrieved_at"`
+	ObservedAt   *time.Time     `json:"observed_at,omitempty"`
+}
+
+type LocationV2 struct {
+	City         string `json:"city"`
+	State        string `json:"state,omitempty"`
+	Neighborhood string `json:"neighborhood,omitempty"`
+	Street       string `json:"street,omitempty"`
+}
+
+// TemperaturesV2 keeps the units filtering of the WeatherResponse, the units
+// not selected are omitted
+type TemperaturesV2 struct {
+	C *float64 `json:"c,omitempty"`
+	F *float64 `json:"f,omitempty"`
+	K *float64 `json:"k,omitempty"`
+}
+
+// Versioned returns the body of the response in the schema version, which
+// must have been validated by ParseSchemaVersion
+func (r WeatherResponse) Versioned(version string) any {
+	if version != SchemaV2 {
+		return r
+	}
+	return WeatherResponseV2{
+		Cep: r.Cep,
+		Location: LocationV2{
+			City:         r.City,
+			State:        r.State,
+			Neighborhood: r.Neighborhood,
+			Street:       r.Street,
+		},
+		Temperatures: TemperaturesV2{C: r.TempC, F: r.TempF, K: r.TempK},
+		Source:       r.Source,
+		Stale:        r.Stale,
+		RetrievedAt:  r.RetrievedAt,
+		ObservedAt:   r.ObservedAt,
+	}
+}
+
+// SetSchemaHeaders tells the schema version of the response and that it
+// depends on the Accept header, for the caches
+func SetSchemaHeaders(w http.ResponseWriter, version string) {
+	w.Header().Set(SchemaVersionHeader, version)
+	w.Header().Add("Vary", "Accept")
+}
+
+// EncodeWeather is EncodeJSON for a WeatherResponse in the schema version
+func EncodeWeather(ctx context.Context, tracer trace.Tracer, w http.ResponseWriter, version string, resp WeatherResponse) error {
+	SetSchemaHeaders(w, version)
+	return EncodeJSON(ctx, tracer, w, resp.Versioned(version))
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Timeout is a chi middleware that bounds the request context to timeout,
+// replacing middleware.Timeout. When the deadline passes a "request.timeout"
+// event is added to the request span and, if the handler returned without
+// answering, a JSON error with status is written, usually 503 or 504. Like
+// the chi one it doesn't interrupt the handler, which must honor the context.
+// It must come after TracingAndMetrics.
+func Timeout(timeout time.Duration, status int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return
+			}
+			// o evento é datado no prazo, não no fim do handler
+			deadline, _ := ctx.Deadline()
+			trace.SpanFromContext(ctx).AddEvent("request.timeout",
+				trace.WithTimestamp(deadline),
+				trace.WithAttributes(attribute.Int64("timeout_ms", timeout.Milliseconds())),
+			)
+			if ww.Status() == 0 && ww.BytesWritten() == 0 {
+				WriteJSONError(ww, status, "timeout", "request timeout")
+			}
+		})
+	}
+}
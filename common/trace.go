@@ -3,53 +3,371 @@ package common
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/contrib/propagators/b3"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/exporters/zipkin"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-func InitProvider(serviceName, collectorURL string) (func(context.Context) error, error) {
+const (
+	ProtocolGRPC         = "grpc"
+	ProtocolHTTPProtobuf = "http/protobuf"
+
+	ExporterOTLP    = "otlp"
+	ExporterConsole = "console"
+	ExporterZipkin  = "zipkin"
+	// ExporterJaeger sends OTLP to the collector built into Jaeger, the
+	// jaeger specific exporter is deprecated
+	ExporterJaeger = "jaeger"
+
+	defaultZipkinURL = "http://localhost:9411/api/v2/spans"
+	defaultJaegerURL = "localhost:4317"
+)
+
+type ProviderConfig struct {
+	ServiceName    string
+	ServiceVersion string
+	Environment    string
+	Exporter       string // ExporterOTLP (default), ExporterConsole, ExporterZipkin or ExporterJaeger
+	CollectorURL   string
+	ZipkinURL      string // span endpoint of zipkin, like http://zipkin:9411/api/v2/spans
+	JaegerURL      string // OTLP endpoint of jaeger, like jaeger:4317
+	Protocol       string // ProtocolGRPC (default) or ProtocolHTTPProtobuf
+	// SamplingRatio is the share of the root spans sampled, between 0 and 1,
+	// nil samples every trace
+	SamplingRatio *float64
+	Propagators   string // comma separated, like "tracecontext,baggage" (default) or "b3multi"
+	// Disabled (OTEL_SDK_DISABLED) installs a no-op tracer provider, the spans
+	// started by the handlers are discarded but the context still propagates
+	Disabled bool
+	// SpanExporter replaces the exporter selected by Exporter, like a
+	// tracetest.InMemoryExporter in tests
+	SpanExporter sdktrace.SpanExporter
+}
+
+// ParseSamplingRatio parses the OTEL_TRACES_SAMPLER_ARG value. A value that
+// isn't a number fails instead of turning into 0, which would stop sampling.
+func ParseSamplingRatio(value string) (float64, error) {
+	ratio, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q: must be a number between 0 and 1", value)
+	}
+	if ratio < 0 || ratio > 1 {
+		return 0, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q: must be between 0 and 1", value)
+	}
+	return ratio, nil
+}
+
+func InitProvider(cfg ProviderConfig) (func(context.Context) error, error) {
 	ctx := context.Background()
 
-	res, err := resource.New(ctx,
-		resource.WithAttributes(
-			semconv.ServiceName(serviceName),
-		),
-	)
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SamplingRatio != nil {
+		if ratio := *cfg.SamplingRatio; ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid sampling ratio %v: must be between 0 and 1", ratio)
+		}
+		sampler = sdktrace.TraceIDRatioBased(*cfg.SamplingRatio)
+	}
+
+	propagator, err := newPropagator(cfg.Propagators)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create resource: %w", err)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	conn, err := grpc.NewClient(collectorURL,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+	if cfg.Disabled {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagator)
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := newResource(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
+		return nil, err
 	}
 
-	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	traceExporter, err := newExporter(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		return nil, err
 	}
 
 	bsp := sdktrace.NewBatchSpanProcessor(traceExporter)
 	tracerProvider := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(debugSampler{delegate: sdktrace.ParentBased(sampler)}),
 		sdktrace.WithResource(res),
+		sdktrace.WithSpanProcessor(redactingProcessor{}),
 		sdktrace.WithSpanProcessor(bsp),
 	)
 	otel.SetTracerProvider(tracerProvider)
 
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTextMapPropagator(propagator)
 
 	return tracerProvider.Shutdown, nil
 }
+
+// newPropagator builds the composite propagator from a list like
+// OTEL_PROPAGATORS, "b3" is the single header and "b3multi" the X-B3-* headers
+func newPropagator(list string) (propagation.TextMapPropagator, error) {
+	if strings.TrimSpace(list) == "" {
+		list = "tracecontext,baggage"
+	}
+	var propagators []propagation.TextMapPropagator
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "tracecontext":
+			propagators = append(propagators, propagation.TraceContext{})
+		case "baggage":
+			propagators = append(propagators, propagation.Baggage{})
+		case "b3":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+		case "b3multi":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		default:
+			return nil, fmt.Errorf("unsupported propagator %q", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
+
+func newResource(ctx context.Context, cfg ProviderConfig) (*resource.Resource, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceName(cfg.ServiceName),
+			semconv.ServiceVersion(cfg.ServiceVersion),
+			semconv.DeploymentEnvironment(cfg.Environment),
+		),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+	return res, nil
+}
+
+func newExporter(ctx context.Context, cfg ProviderConfig) (sdktrace.SpanExporter, error) {
+	if cfg.SpanExporter != nil {
+		return cfg.SpanExporter, nil
+	}
+	switch cfg.Exporter {
+	case "", ExporterOTLP:
+		// without a collector the spans are printed, so the services can
+		// run locally without docker
+		if cfg.CollectorURL == "" {
+			return newConsoleExporter()
+		}
+		return newOTLPExporter(ctx, cfg.Protocol, cfg.CollectorURL)
+	case ExporterConsole:
+		return newConsoleExporter()
+	case ExporterZipkin:
+		url := cfg.ZipkinURL
+		if url == "" {
+			url = defaultZipkinURL
+		}
+		traceExporter, err := zipkin.New(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		}
+		return traceExporter, nil
+	case ExporterJaeger:
+		url := cfg.JaegerURL
+		if url == "" {
+			url = defaultJaegerURL
+		}
+		return newOTLPExporter(ctx, cfg.Protocol, url)
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter %q", cfg.Exporter)
+	}
+}
+
+func newConsoleExporter() (sdktrace.SpanExporter, error) {
+	traceExporter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	return traceExporter, nil
+}
+
+func newOTLPExporter(ctx context.Context, protocol, collectorURL string) (sdktrace.SpanExporter, error) {
+	switch protocol {
+	case "", ProtocolGRPC:
+		conn, err := grpc.NewClient(collectorURL,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
+		}
+		traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		}
+		return traceExporter, nil
+	case ProtocolHTTPProtobuf:
+		traceExporter, err := otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpoint(collectorURL),
+			otlptracehttp.WithInsecure(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		}
+		return traceExporter, nil
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+}
+
+// RecordDeadline records on the span how much time was left until the ctx
+// deadline, telling slow calls apart from calls that started near the deadline.
+// Nothing is recorded when ctx has no deadline.
+func RecordDeadline(ctx context.Context, span trace.Span) {
+	if deadline, ok := ctx.Deadline(); ok {
+		span.SetAttributes(attribute.Int64("context.deadline_remaining_ms", time.Until(deadline).Milliseconds()))
+	}
+}
+
+// SpanNameFormatter names the server spans after the chi route pattern, like
+// "GET /weather", never the concrete URL, so CEPs in the path or the query
+// can't blow up the span name cardinality. Unmatched requests are named by
+// the method alone.
+func SpanNameFormatter(method, route string) string {
+	if route == "" {
+		return method
+	}
+	return method + " " + route
+}
+
+// TracingAndMetrics is a chi middleware that extracts the propagated trace
+// context, starts the server span of the request and records the request
+// count and latency. The handlers get the span from the request context.
+func TracingAndMetrics(tracer trace.Tracer) func(http.Handler) http.Handler {
+	instruments := newRequestInstruments(otel.Meter("microservice-meter"))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			warnInvalidTraceparent(ctx, r)
+			// o nome definitivo só é conhecido depois do roteamento
+			ctx, span := tracer.Start(ctx, SpanNameFormatter(r.Method, ""),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+				),
+				trace.WithAttributes(debugTraceAttributes(r)...),
+			)
+			defer span.End()
+
+			ww := &writeErrorRecorder{WrapResponseWriter: middleware.NewWrapResponseWriter(w, r.ProtoMajor)}
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			// the route pattern is only known after chi routed the request
+			route := chi.RouteContext(r.Context()).RoutePattern()
+			status := ww.Status()
+			if status == 0 { // o handler não escreveu nada, o net/http responde 200
+				status = http.StatusOK
+			}
+			span.SetName(SpanNameFormatter(r.Method, route))
+			span.SetAttributes(
+				attribute.String("http.route", route),
+				attribute.Int("http.response.status_code", status),
+			)
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			RecordResponseError(ctx, ww.err,
+				slog.String("route", route),
+				slog.Int("status", status),
+				slog.Int("bytes_written", ww.BytesWritten()),
+			)
+			instruments.record(ctx, route, status, time.Since(start))
+		})
+	}
+}
+
+// writeErrorRecorder keeps the first error writing the response body, the
+// encoders of the handlers can't report it to the client once the status
+// was sent
+type writeErrorRecorder struct {
+	middleware.WrapResponseWriter
+	err error
+}
+
+func (w *writeErrorRecorder) Write(b []byte) (int, error) {
+	n, err := w.WrapResponseWriter.Write(b)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Flush keeps the writer usable for streaming, the embedded interface does
+// not expose it
+func (w *writeErrorRecorder) Flush() {
+	if f, ok := w.WrapResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// maxLoggedHeader bounds the header value logged, the header comes from the client
+const maxLoggedHeader = 128
+
+// warnInvalidTraceparent logs when the request carries a malformed traceparent
+// header, the request then starts a new trace and shows up disconnected from
+// its caller. Without the tracecontext propagator, like with OTEL_PROPAGATORS=b3,
+// the header is never extracted and is not checked.
+func warnInvalidTraceparent(ctx context.Context, r *http.Request) {
+	traceparent := r.Header.Get("traceparent")
+	if traceparent == "" || !slices.Contains(otel.GetTextMapPropagator().Fields(), "traceparent") {
+		return
+	}
+	// o header é validado sozinho, um contexto extraído de outro header não diz nada sobre ele
+	valid := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(r.Header)))
+	if valid.IsValid() {
+		return
+	}
+	if len(traceparent) > maxLoggedHeader {
+		traceparent = traceparent[:maxLoggedHeader] + "..."
+	}
+	LoggerFromContext(ctx).Warn("invalid traceparent header, starting a new trace",
+		slog.String("traceparent", traceparent),
+		slog.String("path", r.URL.Path),
+	)
+}
+
+// CorrelationHeaders echoes the request id and the trace id of the request
+// span in the X-Request-ID and X-Trace-ID response headers. The headers are
+// set before the handler runs so error responses carry them too, so it must
+// come after the RequestID and TracingAndMetrics middlewares
+func CorrelationHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reqID := middleware.GetReqID(r.Context()); reqID != "" {
+			w.Header().Set("X-Request-ID", reqID)
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			w.Header().Set("X-Trace-ID", sc.TraceID().String())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
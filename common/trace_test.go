@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// failingWriter is a ResponseWriter whose client went away after the headers
+type failingWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *failingWriter) Header() http.Header       { return w.header }
+func (w *failingWriter) WriteHeader(status int)    { w.status = status }
+func (w *failingWriter) Write([]byte) (int, error) { return 0, errors.New("write: broken pipe") }
+
+func TestTracingAndMetricsRecordsWriteError(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(NewLogger(&logs, slog.LevelInfo))
+	defer slog.SetDefault(defaultLogger)
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	router := chi.NewRouter()
+	router.Use(TracingAndMetrics(tracer))
+	router.Get("/weather", func(w http.ResponseWriter, r *http.Request) {
+		EncodeJSON(r.Context(), tracer, w, WeatherResponse{City: "São Paulo"})
+	})
+	router.ServeHTTP(&failingWriter{header: http.Header{}}, httptest.NewRequest(http.MethodGet, "/weather", nil))
+
+	var server sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "GET /weather" {
+			server = span
+		}
+	}
+	if server == nil {
+		t.Fatalf("no server span in %d ended spans", len(recorder.Ended()))
+	}
+	if server.Status().Code != codes.Error || server.Status().Description != "failed to write response" {
+		t.Errorf("server span status = %+v, want the write error", server.Status())
+	}
+	if events := server.Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("server span events = %+v, want the recorded error", events)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log %q: %v", logs.String(), err)
+	}
+	want := map[string]any{
+		"msg":      "failed to write response",
+		"error":    "write: broken pipe",
+		"route":    "/weather",
+		"status":   float64(http.StatusOK),
+		"trace_id": server.SpanContext().TraceID().String(),
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("log %s = %v, want %v", key, entry[key], value)
+		}
+	}
+}
+
+func TestWarnInvalidTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name        string
+		propagators string
+		headers     http.Header
+		wantWarning bool
+	}{
+		{"valid traceparent", "tracecontext,baggage", http.Header{"Traceparent": {valid}}, false},
+		{"malformed traceparent", "tracecontext,baggage", http.Header{"Traceparent": {"00-xyz"}}, true},
+		{"malformed traceparent next to a valid b3", "tracecontext,b3", http.Header{"Traceparent": {"00-xyz"}, "B3": {"4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"}}, true},
+		{"valid traceparent with b3 only", "b3", http.Header{"Traceparent": {valid}}, false},
+		{"malformed traceparent with b3 only", "b3", http.Header{"Traceparent": {"00-xyz"}}, false},
+		{"no traceparent", "tracecontext", http.Header{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restoreOtel(t)
+			propagator, err := newPropagator(tt.propagators)
+			if err != nil {
+				t.Fatal(err)
+			}
+			otel.SetTextMapPropagator(propagator)
+			var logs bytes.Buffer
+			defaultLogger := slog.Default()
+			slog.SetDefault(NewLogger(&logs, slog.LevelInfo))
+			defer slog.SetDefault(defaultLogger)
+
+			r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+			r.Header = tt.headers
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			warnInvalidTraceparent(ctx, r)
+
+			if warned := strings.Contains(logs.String(), "invalid traceparent header"); warned != tt.wantWarning {
+				t.Errorf("warned = %v, want %v: %s", warned, tt.wantWarning, logs.String())
+			}
+		})
+	}
+}
@@ -1,8 +1,92 @@
 package common
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	UnitsCelsius    = "c"
+	UnitsFahrenheit = "f"
+	UnitsKelvin     = "k"
+	UnitsAll        = "all"
+)
+
+// ErrImplausibleTemperature is returned by WeatherResponse.Validate when the
+// temperature is out of the TemperatureBounds
+var ErrImplausibleTemperature = errors.New("implausible temperature")
+
+// TemperatureBounds is the plausible range of a temperature reading in °C
+type TemperatureBounds struct {
+	MinC float64
+	MaxC float64
+}
+
+// DefaultTemperatureBounds is a bit beyond the lowest and highest temperatures
+// ever recorded
+var DefaultTemperatureBounds = TemperatureBounds{MinC: -90, MaxC: 60}
+
 type WeatherResponse struct {
-	City  string  `json:"city"`
-	TempC float64 `json:"temp_C"`
-	TempF float64 `json:"temp_F"`
-	TempK float64 `json:"temp_K"`
+	Cep  string `json:"cep"`
+	City string `json:"city"`
+	// State is the UF of the city, like "SP"
+	State string `json:"state,omitempty"`
+	// Neighborhood and Street are the bairro and logradouro of the CEP, only
+	// filled when asked with detail=full
+	Neighborhood string `json:"neighborhood,omitempty"`
+	Street       string `json:"street,omitempty"`
+	// the temperatures not selected by the units are left nil and omitted
+	TempC *float64 `json:"temp_C,omitempty"`
+	TempF *float64 `json:"temp_F,omitempty"`
+	TempK *float64 `json:"temp_K,omitempty"`
+	// Source identifies the upstream provider that answered the temperature
+	Source string `json:"source,omitempty"`
+	// Stale tells the temperature is the last known reading, served because
+	// the providers are failing, and RetrievedAt when it was read
+	Stale       bool      `json:"stale,omitempty"`
+	RetrievedAt time.Time `json:"retrieved_at"`
+	// ObservedAt is when the provider measured the temperature, omitted when
+	// the provider doesn't tell
+	ObservedAt *time.Time `json:"observed_at,omitempty"`
+}
+
+// ErrorResponse is the body of the error responses, like
+// {"error": {"code": "invalid_zipcode", "message": "invalid zipcode"}}
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message"`
+	Details *ValidationError `json:"details,omitempty"`
+}
+
+// WithUnits returns the response with only the temperature of units, which
+// must have been validated by ParseUnits
+func (r WeatherResponse) WithUnits(units string) WeatherResponse {
+	if units != UnitsCelsius && units != UnitsAll {
+		r.TempC = nil
+	}
+	if units != UnitsFahrenheit && units != UnitsAll {
+		r.TempF = nil
+	}
+	if units != UnitsKelvin && units != UnitsAll {
+		r.TempK = nil
+	}
+	return r
+}
+
+// Validate checks the temperature is inside bounds, the providers sometimes
+// answer readings like -9999 on bad input. Only TempC is checked, the other
+// units are converted from it
+func (r WeatherResponse) Validate(bounds TemperatureBounds) error {
+	if r.TempC == nil {
+		return nil
+	}
+	if *r.TempC < bounds.MinC || *r.TempC > bounds.MaxC {
+		return fmt.Errorf("%w: %v°C outside %v°C to %v°C", ErrImplausibleTemperature, *r.TempC, bounds.MinC, bounds.MaxC)
+	}
+	return nil
 }
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWeatherResponseValidate(t *testing.T) {
+	temp := func(c float64) *float64 { return &c }
+	tests := []struct {
+		name  string
+		tempC *float64
+		want  error
+	}{
+		{"inside the bounds", temp(25), nil},
+		{"at the lower bound", temp(-90), nil},
+		{"at the upper bound", temp(60), nil},
+		{"below the lower bound", temp(-90.1), ErrImplausibleTemperature},
+		{"above the upper bound", temp(500), ErrImplausibleTemperature},
+		{"kelvin sent as celsius", temp(298.15), ErrImplausibleTemperature},
+		{"no temperature", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := WeatherResponse{TempC: tt.tempC}.Validate(DefaultTemperatureBounds)
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("Validate() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package common
+
+import "net/http"
+
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+// UserAgentTransport sets the User-Agent header on every request sent through
+// base that doesn't set one, instead of Go's default agent
+func UserAgentTransport(base http.RoundTripper, userAgent string) http.RoundTripper {
+	if userAgent == "" {
+		userAgent = DefaultUserAgent()
+	}
+	return &userAgentTransport{base: base, userAgent: userAgent}
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// o RoundTripper não deve alterar a requisição recebida
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// FieldError is the problem of a single input field, like "ceps[2]"
+type FieldError struct {
+	Field   string `json:"field"`
+	Value   string `json:"value"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError accumulates the problems of a request, so all of them are
+// reported at once instead of only the first. It serializes to the array of
+// problems.
+type ValidationError struct {
+	Problems []FieldError
+}
+
+func (e *ValidationError) Add(field, value, code, message string) {
+	e.Problems = append(e.Problems, FieldError{Field: field, Value: value, Code: code, Message: message})
+}
+
+func (e *ValidationError) HasProblems() bool {
+	return len(e.Problems) > 0
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Field + ": " + p.Message
+	}
+	return fmt.Sprintf("%d invalid fields: %s", len(e.Problems), strings.Join(problems, "; "))
+}
+
+func (e *ValidationError) MarshalJSON() ([]byte, error) {
+	if e.Problems == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(e.Problems)
+}
+
+// WriteValidationError answers 422 with the code validation_failed and the
+// problems in the details of the error
+func WriteValidationError(w http.ResponseWriter, err *ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetail{Code: "validation_failed", Message: err.Error(), Details: err}})
+}
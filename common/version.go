@@ -0,0 +1,32 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Version, GitCommit and BuildTime are set at build time with
+// -ldflags "-X github.com/mobenaus/fc-pos-go-labs-observabilidade/common.Version=..."
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
+)
+
+// DefaultUserAgent is the User-Agent of the outbound requests when
+// HTTP_USER_AGENT is not set
+func DefaultUserAgent() string {
+	return "fc-pos-observabilidade/" + Version
+}
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+}
+
+// VersionHandler answers the build info, for support and canary checks
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionInfo{Version: Version, GitCommit: GitCommit, BuildTime: BuildTime})
+}
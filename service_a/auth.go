@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// APIKeyAuth answers 401 to the requests without one of the keys in the
+// X-API-Key header. With no keys configured every request is accepted.
+func APIKeyAuth(keys []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("X-API-Key")
+			reason := "missing"
+			if key != "" {
+				if validAPIKey(key, keys) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				reason = "invalid"
+			}
+			common.WriteJSONError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid API key")
+			// a chave recebida não vai para o trace nem para o log
+			span := trace.SpanFromContext(r.Context())
+			span.AddEvent("auth.failed", trace.WithAttributes(
+				attribute.String("auth.reason", reason),
+			))
+			span.SetStatus(codes.Error, "missing or invalid API key")
+		})
+	}
+}
+
+// RequireAPIKeys answers 403 admin_disabled when no keys are configured,
+// keeping the admin endpoints closed instead of open like the others
+func RequireAPIKeys(keys []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(keys) > 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			common.WriteJSONError(w, http.StatusForbidden, "admin_disabled", "admin endpoints require API_KEYS")
+			trace.SpanFromContext(r.Context()).SetStatus(codes.Error, "admin endpoints require API_KEYS")
+		})
+	}
+}
+
+func validAPIKey(key string, keys []string) bool {
+	valid := false
+	for _, k := range keys {
+		// comparação em tempo constante, sem parar na primeira chave que confere
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type BatchEntrada struct {
+	CEPs []string `json:"ceps"`
+}
+
+// UnmarshalJSON accepts both {"ceps": [...]} and the bare array [...]
+func (e *BatchEntrada) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(trimmed, &e.CEPs)
+	}
+	type plain BatchEntrada // sem o método, para não recursar
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+// BatchResponse separates the CEPs answered from the ones that failed, both
+// in the order they were sent
+type BatchResponse struct {
+	Results []common.WeatherResponse `json:"results"`
+	Errors  []BatchError             `json:"errors"`
+}
+
+// versioned returns the response with the results in the schema version
+func (b BatchResponse) versioned(version string) any {
+	if version == common.SchemaV1 {
+		return b
+	}
+	results := make([]any, 0, len(b.Results))
+	for _, result := range b.Results {
+		results = append(results, result.Versioned(version))
+	}
+	return struct {
+		Results []any        `json:"results"`
+		Errors  []BatchError `json:"errors"`
+	}{results, b.Errors}
+}
+
+// BatchError has the same code and message of the single lookup error
+type BatchError struct {
+	Cep     string `json:"cep"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	status  int
+}
+
+// batchItem is the outcome of a single CEP, either the weather or the error
+type batchItem struct {
+	result *common.WeatherResponse
+	err    *BatchError
+}
+
+func (ws *WebServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+
+	// the propagated trace context was extracted by the tracing middleware
+	ctx := r.Context()
+
+	ctx, spanValidation := ws.Tracer.Start(ctx, "Validate inputs")
+	ctx = withTenant(ctx, r, spanValidation)
+
+	var entrada BatchEntrada
+	if err := common.DecodeJSON(ctx, ws.Tracer, r.Body, &entrada); err != nil {
+		writeDecodeError(w, spanValidation, err)
+		return
+	}
+	spanValidation.SetAttributes(
+		attribute.Int("batch.size", len(entrada.CEPs)),
+		attribute.Int("batch.max_size", ws.BatchMaxSize),
+	)
+	if ws.batchTooLarge(w, spanValidation, len(entrada.CEPs)) {
+		spanValidation.End()
+		return
+	}
+	units, err := common.ParseUnits(r.URL.Query().Get("units"))
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_units", err.Error())
+		spanValidation.RecordError(err)
+		spanValidation.SetStatus(codes.Error, err.Error())
+		spanValidation.End()
+		return
+	}
+	version, err := common.ParseSchemaVersion(r)
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_version", err.Error())
+		spanValidation.RecordError(err)
+		spanValidation.SetStatus(codes.Error, err.Error())
+		spanValidation.End()
+		return
+	}
+	detail, err := common.ParseDetail(r.URL.Query().Get("detail"))
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_detail", err.Error())
+		spanValidation.RecordError(err)
+		spanValidation.SetStatus(codes.Error, err.Error())
+		spanValidation.End()
+		return
+	}
+
+	// todos os CEPs são validados antes das consultas, os inválidos viram
+	// erros dos seus itens e, se nenhum for válido, um único 422 lista todos
+	items := make([]batchItem, len(entrada.CEPs))
+	var validation common.ValidationError
+	for idx, rawCEP := range entrada.CEPs {
+		field := fmt.Sprintf("ceps[%d]", idx)
+		cep, err := ws.PostalCodes.Normalize(rawCEP)
+		if err != nil {
+			validation.Add(field, rawCEP, "invalid_zipcode", "invalid zipcode")
+			items[idx].err = &BatchError{Cep: rawCEP, Code: "invalid_zipcode", Message: "invalid zipcode", status: http.StatusUnprocessableEntity}
+			continue
+		}
+		if !common.CEPInAllowedRange(cep, ws.AllowedCEPPrefixes) {
+			validation.Add(field, cep, "zipcode_not_allowed", common.ErrCEPNotAllowed.Error())
+			items[idx].err = &BatchError{Cep: cep, Code: "zipcode_not_allowed", Message: common.ErrCEPNotAllowed.Error(), status: http.StatusUnprocessableEntity}
+			continue
+		}
+		entrada.CEPs[idx] = cep
+	}
+	if len(entrada.CEPs) > 0 && len(validation.Problems) == len(entrada.CEPs) {
+		common.WriteValidationError(w, &validation)
+		spanValidation.RecordError(&validation)
+		spanValidation.SetStatus(codes.Error, validation.Error())
+		spanValidation.End()
+		return
+	}
+	spanValidation.SetAttributes(attribute.Int("batch.invalid", len(validation.Problems)))
+	spanValidation.End()
+
+	// os sub-requests apontam para o span do lote mesmo quando o sampling
+	// descarta o pai e mantém o filho
+	batchLink := trace.LinkFromContext(r.Context(), attribute.String("link.type", "batch"))
+
+	if ws.BatchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ws.BatchTimeout)
+		defer cancel()
+	}
+	if r.URL.Query().Get("stream") == "true" {
+		ws.streamBatch(ctx, w, r, batchLink, entrada.CEPs, items, units, detail, version)
+		return
+	}
+	completed, timedOut := ws.runBatch(ctx, batchLink, entrada.CEPs, items, units, detail, nil)
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.Int("batch.size", len(entrada.CEPs)),
+		attribute.Int("batch.concurrency", ws.BatchConcurrency),
+		attribute.Int("batch.completed", completed),
+		attribute.Int("batch.timed_out", timedOut),
+	)
+
+	response, status := aggregateBatch(items)
+	common.SetSchemaHeaders(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	common.EncodeJSON(ctx, ws.Tracer, w, response.versioned(version))
+}
+
+// batchStreamLine is a line of the NDJSON batch stream, with either the
+// result or the error of a CEP
+type batchStreamLine struct {
+	Result any         `json:"result,omitempty"`
+	Error  *BatchError `json:"error,omitempty"`
+}
+
+// streamBatch answers the batch as NDJSON, one line per CEP flushed as soon
+// as its lookup finishes, so the lines come in completion order and not in
+// the order sent. The status is always 200, the failures are in the lines.
+// When the client goes away the pending lookups are canceled.
+func (ws *WebServer) streamBatch(ctx context.Context, w http.ResponseWriter, r *http.Request, batchLink trace.Link, ceps []string, items []batchItem, units, detail, version string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	common.SetSchemaHeaders(w, version)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	streamed := 0
+	writeFailed := false
+	emit := func(item batchItem) {
+		if writeFailed {
+			return
+		}
+		line := batchStreamLine{Error: item.err}
+		if item.result != nil {
+			line.Result = item.result.Versioned(version)
+		}
+		err := enc.Encode(line)
+		if err == nil {
+			if err = rc.Flush(); errors.Is(err, http.ErrNotSupported) {
+				err = nil
+			}
+		}
+		if err != nil { // o cliente desconectou, as consultas pendentes são canceladas
+			writeFailed = true
+			cancel()
+			return
+		}
+		streamed++
+	}
+
+	// os erros de validação já são conhecidos e saem antes das consultas
+	for _, item := range items {
+		if item.err != nil {
+			emit(item)
+		}
+	}
+	completed, timedOut := ws.runBatch(ctx, batchLink, ceps, items, units, detail, emit)
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.Int("batch.size", len(ceps)),
+		attribute.Int("batch.concurrency", ws.BatchConcurrency),
+		attribute.Int("batch.completed", completed),
+		attribute.Int("batch.timed_out", timedOut),
+		attribute.Bool("batch.stream", true),
+		attribute.Int("batch.streamed", streamed),
+		attribute.Bool("batch.client_disconnected", writeFailed || errors.Is(r.Context().Err(), context.Canceled)),
+	)
+}
+
+// indexedItem is the outcome of the CEP at idx, sent by the workers
+type indexedItem struct {
+	idx  int
+	item batchItem
+}
+
+// runBatch looks up the CEPs of the items without an error on
+// BatchConcurrency workers. When ctx is done before every lookup finished,
+// the ones still pending or running are marked as timed out instead of
+// waited for. Each item is also passed to emit, when not nil, as soon as it
+// is known. It returns how many lookups completed and how many timed out.
+func (ws *WebServer) runBatch(ctx context.Context, batchLink trace.Link, ceps []string, items []batchItem, units, detail string, emit func(batchItem)) (completed, timedOut int) {
+	var pending []int
+	for idx := range items {
+		if items[idx].err == nil {
+			pending = append(pending, idx)
+		}
+	}
+	if len(pending) == 0 {
+		return 0, 0
+	}
+
+	// com buffer, os workers que terminam depois do prazo não ficam bloqueados
+	results := make(chan indexedItem, len(pending))
+	jobs := make(chan int)
+	for i := 0; i < min(ws.BatchConcurrency, len(pending)); i++ {
+		go func() {
+			for idx := range jobs {
+				results <- indexedItem{idx: idx, item: ws.batchItem(ctx, batchLink, Entrada{CEP: ceps[idx], Detail: detail}, units)}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, idx := range pending {
+			select {
+			case jobs <- idx:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	done := make([]bool, len(items))
+collect:
+	for completed < len(pending) {
+		select {
+		case result := <-results:
+			items[result.idx] = result.item
+			done[result.idx] = true
+			completed++
+			if emit != nil {
+				emit(result.item)
+			}
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	for _, idx := range pending {
+		if !done[idx] {
+			items[idx] = batchItem{err: &BatchError{Cep: ceps[idx], Code: "timeout", Message: "batch deadline exceeded", status: http.StatusGatewayTimeout}}
+			timedOut++
+			if emit != nil {
+				emit(items[idx])
+			}
+		}
+	}
+	return completed, timedOut
+}
+
+// batchTooLarge answers 400 batch_too_large when the list has more than
+// BatchMaxSize CEPs, for both /batch and the warm-up
+func (ws *WebServer) batchTooLarge(w http.ResponseWriter, span trace.Span, size int) bool {
+	if size <= ws.BatchMaxSize {
+		return false
+	}
+	err := fmt.Errorf("batch of %d ceps exceeds the maximum of %d", size, ws.BatchMaxSize)
+	common.WriteJSONError(w, http.StatusBadRequest, "batch_too_large", err.Error())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return true
+}
+
+// aggregateBatch splits the items in results and errors. The status is 200
+// when every CEP was answered, the status shared by all the errors when every
+// CEP failed the same way, like 422, and 207 Multi-Status otherwise.
+func aggregateBatch(items []batchItem) (BatchResponse, int) {
+	response := BatchResponse{Results: []common.WeatherResponse{}, Errors: []BatchError{}}
+	for _, item := range items {
+		if item.err != nil {
+			response.Errors = append(response.Errors, *item.err)
+			continue
+		}
+		response.Results = append(response.Results, *item.result)
+	}
+
+	if len(response.Errors) == 0 {
+		return response, http.StatusOK
+	}
+	if len(response.Results) == 0 {
+		status := response.Errors[0].status
+		for _, e := range response.Errors[1:] {
+			if e.status != status {
+				return response, http.StatusMultiStatus
+			}
+		}
+		return response, status
+	}
+	return response, http.StatusMultiStatus
+}
+
+// batchItem looks up a single validated CEP of the batch in its own span,
+// reporting the failures in the item instead of failing the whole batch, the
+// span is linked to the batch span
+func (ws *WebServer) batchItem(ctx context.Context, batchLink trace.Link, entrada Entrada, units string) batchItem {
+	ctx, span := ws.Tracer.Start(ctx, "Call to service_b",
+		trace.WithAttributes(attribute.String("cep", entrada.CEP)),
+		trace.WithLinks(batchLink),
+	)
+	defer span.End()
+
+	response, err := ws.getTemperaturaCached(ctx, span, entrada)
+	if err != nil {
+		status, code, message := statusForError(err)
+		recordCallError(span, err, status, message)
+		return batchItem{err: &BatchError{Cep: entrada.CEP, Code: code, Message: message, status: status}}
+	}
+	response = response.WithUnits(units)
+	return batchItem{result: &response}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+)
+
+func TestAggregateBatch(t *testing.T) {
+	ok := func(cep string) batchItem {
+		return batchItem{result: &common.WeatherResponse{Cep: cep, City: "São Paulo"}}
+	}
+	fail := func(cep, code string, status int) batchItem {
+		return batchItem{err: &BatchError{Cep: cep, Code: code, Message: code, status: status}}
+	}
+
+	tests := []struct {
+		name        string
+		items       []batchItem
+		wantStatus  int
+		wantResults []string
+		wantErrors  []string
+	}{
+		{
+			name:        "all success",
+			items:       []batchItem{ok("01001000"), ok("20040030")},
+			wantStatus:  http.StatusOK,
+			wantResults: []string{"01001000", "20040030"},
+		},
+		{
+			name:       "all failed the same way",
+			items:      []batchItem{fail("00000000", "zipcode_not_found", http.StatusNotFound), fail("99999999", "zipcode_not_found", http.StatusNotFound)},
+			wantStatus: http.StatusNotFound,
+			wantErrors: []string{"00000000", "99999999"},
+		},
+		{
+			name:       "all failed differently",
+			items:      []batchItem{fail("0100", "invalid_zipcode", http.StatusUnprocessableEntity), fail("20040030", "upstream_error", http.StatusBadGateway)},
+			wantStatus: http.StatusMultiStatus,
+			wantErrors: []string{"0100", "20040030"},
+		},
+		{
+			name:        "mixed",
+			items:       []batchItem{fail("0100", "invalid_zipcode", http.StatusUnprocessableEntity), ok("01001000"), fail("20040030", "upstream_error", http.StatusBadGateway)},
+			wantStatus:  http.StatusMultiStatus,
+			wantResults: []string{"01001000"},
+			wantErrors:  []string{"0100", "20040030"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, status := aggregateBatch(tt.items)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			var results, errs []string
+			for _, r := range response.Results {
+				results = append(results, r.Cep)
+			}
+			for _, e := range response.Errors {
+				errs = append(errs, e.Cep)
+			}
+			if !slices.Equal(results, tt.wantResults) {
+				t.Errorf("results = %v, want %v", results, tt.wantResults)
+			}
+			if !slices.Equal(errs, tt.wantErrors) {
+				t.Errorf("errors = %v, want %v", errs, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestBatchReportsEveryInvalidCEP(t *testing.T) {
+	ws := newTestWebServer(t, "http://127.0.0.1:0")
+	ws.AllowedCEPPrefixes = []string{"01"}
+
+	rec := httptest.NewRecorder()
+	ws.handleBatch(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`{"ceps":["123","20040030","abcdefgh"]}`)))
+
+	var body struct {
+		Error struct {
+			Code    string              `json:"code"`
+			Details []common.FieldError `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusUnprocessableEntity || body.Error.Code != "validation_failed" {
+		t.Fatalf("batch = %d %q, want %d validation_failed", rec.Code, body.Error.Code, http.StatusUnprocessableEntity)
+	}
+	want := []common.FieldError{
+		{Field: "ceps[0]", Value: "123", Code: "invalid_zipcode", Message: "invalid zipcode"},
+		{Field: "ceps[1]", Value: "20040030", Code: "zipcode_not_allowed", Message: common.ErrCEPNotAllowed.Error()},
+		{Field: "ceps[2]", Value: "abcdefgh", Code: "invalid_zipcode", Message: "invalid zipcode"},
+	}
+	if !slices.Equal(body.Error.Details, want) {
+		t.Errorf("details = %+v, want %+v", body.Error.Details, want)
+	}
+}
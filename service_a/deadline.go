@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TimeoutHeader lets the caller set its own budget for the service_b lookup,
+// like "X-Timeout-Ms: 2000"
+const TimeoutHeader = "X-Timeout-Ms"
+
+type lookupTimeoutKey struct{}
+
+// LookupTimeout takes the budget of the service_b lookups of the request from
+// the X-Timeout-Ms header, capped at maxTimeout. Without the header, or when
+// it isn't a positive integer, the weatherServiceTimeout default is kept.
+func LookupTimeout(maxTimeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw := r.Header.Get(TimeoutHeader)
+			if raw == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			span := trace.SpanFromContext(r.Context())
+			ms, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || ms <= 0 { // o valor inválido não impede a consulta, apenas é ignorado
+				span.SetAttributes(attribute.Bool("timeout.header_invalid", true))
+				next.ServeHTTP(w, r)
+				return
+			}
+			timeout := time.Duration(ms) * time.Millisecond
+			if ms > maxTimeout.Milliseconds() {
+				timeout = maxTimeout
+				span.SetAttributes(attribute.Bool("timeout.header_capped", true))
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), lookupTimeoutKey{}, timeout)))
+		})
+	}
+}
+
+// lookupTimeout is the budget of a service_b lookup in ctx, retries included
+func lookupTimeout(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(lookupTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return weatherServiceTimeout
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotencyKey bounds the key kept in memory, UUIDs have 36 characters
+	maxIdempotencyKey = 255
+)
+
+// storedResponse is the response replayed for an idempotency key, the
+// fingerprint identifies the request that produced it
+type storedResponse struct {
+	fingerprint string
+	status      int
+	contentType string
+	schema      string
+	body        []byte
+}
+
+// IdempotencyStore keeps the responses by idempotency key, like a
+// common.TTLCache whose ttl is the replay window
+type IdempotencyStore interface {
+	GetContext(ctx context.Context, key string) (storedResponse, bool)
+	SetContext(ctx context.Context, key string, response storedResponse)
+}
+
+// Idempotency replays the stored response to the requests repeating an
+// Idempotency-Key instead of querying service_b again. Only the responses
+// below 500 are stored, so a failed request can still be retried. Reusing a
+// key with another payload answers 422. The key is reserved while its first
+// request runs, a concurrent request with the same key answers 409 instead of
+// querying service_b too. Requests without the header pass through.
+func Idempotency(store IdempotencyStore) func(http.Handler) http.Handler {
+	// fingerprint by key of the requests running, the lock also covers the
+	// lookup in the store so a key is never both missing and unreserved
+	var mu sync.Mutex
+	inFlight := make(map[string]string)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			span := trace.SpanFromContext(r.Context())
+			if len(key) > maxIdempotencyKey {
+				common.WriteJSONError(w, http.StatusBadRequest, "invalid_idempotency_key", "idempotency key too long")
+				span.SetStatus(codes.Error, "idempotency key too long")
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil { // o handler responde o erro da leitura, como o payload muito grande
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := requestFingerprint(r, body)
+
+			mu.Lock()
+			if reserved, ok := inFlight[key]; ok {
+				mu.Unlock()
+				if reserved != fingerprint {
+					writeKeyReused(w, span)
+					return
+				}
+				w.Header().Set("Retry-After", "1")
+				common.WriteJSONError(w, http.StatusConflict, "idempotency_key_in_flight", "a request with this idempotency key is still running")
+				span.SetAttributes(attribute.Bool("idempotency.in_flight", true))
+				span.SetStatus(codes.Error, "a request with this idempotency key is still running")
+				return
+			}
+			stored, ok := store.GetContext(r.Context(), key)
+			if !ok {
+				inFlight[key] = fingerprint
+			}
+			mu.Unlock()
+
+			if ok {
+				if stored.fingerprint != fingerprint {
+					writeKeyReused(w, span)
+					return
+				}
+				span.SetAttributes(attribute.Bool("idempotency.replayed", true))
+				w.Header().Set("Content-Type", stored.contentType)
+				if stored.schema != "" {
+					common.SetSchemaHeaders(w, stored.schema)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.status)
+				w.Write(stored.body)
+				return
+			}
+			span.SetAttributes(attribute.Bool("idempotency.replayed", false))
+
+			var buf bytes.Buffer
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&buf)
+			// a reserva é liberada mesmo se o handler entrar em pânico
+			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if status := ww.Status(); status > 0 && status < http.StatusInternalServerError {
+					store.SetContext(r.Context(), key, storedResponse{
+						fingerprint: fingerprint,
+						status:      status,
+						contentType: ww.Header().Get("Content-Type"),
+						schema:      ww.Header().Get(common.SchemaVersionHeader),
+						body:        buf.Bytes(),
+					})
+				}
+				delete(inFlight, key)
+			}()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
+
+func writeKeyReused(w http.ResponseWriter, span trace.Span) {
+	common.WriteJSONError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "idempotency key already used with another payload")
+	span.SetAttributes(attribute.Bool("idempotency.conflict", true))
+	span.SetStatus(codes.Error, "idempotency key already used with another payload")
+}
+
+// requestFingerprint hashes the query, the Accept header and the body, the
+// units and the schema version change the response as much as the payload
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.URL.RawQuery))
+	h.Write([]byte{0})
+	h.Write([]byte(r.Header.Get("Accept")))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
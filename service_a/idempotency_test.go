@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+)
+
+func idempotentRequest(key, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(IdempotencyKeyHeader, key)
+	return req
+}
+
+func TestIdempotencyConcurrentRequests(t *testing.T) {
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := Idempotency(common.NewTTLCache[storedResponse](time.Hour))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"city":"São Paulo"}`))
+	}))
+
+	// a primeira requisição fica presa no handler enquanto as demais chegam
+	first := httptest.NewRecorder()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler.ServeHTTP(first, idempotentRequest("key-1", `{"cep":"01001000"}`))
+	}()
+	<-started
+
+	const concurrent = 5
+	statuses := make([]int, concurrent)
+	var others sync.WaitGroup
+	for i := range concurrent {
+		others.Add(1)
+		go func() {
+			defer others.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, idempotentRequest("key-1", `{"cep":"01001000"}`))
+			statuses[i] = rec.Code
+		}()
+	}
+	others.Wait()
+	for i, status := range statuses {
+		if status != http.StatusConflict {
+			t.Errorf("concurrent request %d status = %d, want %d", i, status, http.StatusConflict)
+		}
+	}
+
+	// outro payload com a mesma chave continua sendo um conflito de payload
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, idempotentRequest("key-1", `{"cep":"20040030"}`))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("other payload status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+
+	close(release)
+	wg.Wait()
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want %d", first.Code, http.StatusOK)
+	}
+
+	replay := httptest.NewRecorder()
+	handler.ServeHTTP(replay, idempotentRequest("key-1", `{"cep":"01001000"}`))
+	if replay.Code != http.StatusOK || replay.Header().Get("Idempotent-Replayed") != "true" || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %q replayed=%q, want the stored response", replay.Code, replay.Body.String(), replay.Header().Get("Idempotent-Replayed"))
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyReleasesFailedKey(t *testing.T) {
+	var calls atomic.Int32
+	handler := Idempotency(common.NewTTLCache[storedResponse](time.Hour))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			common.WriteJSONError(w, http.StatusBadGateway, "upstream_error", "weather service request failed")
+			return
+		}
+		w.Write([]byte(`{"city":"São Paulo"}`))
+	}))
+
+	for i, want := range []int{http.StatusBadGateway, http.StatusOK} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, idempotentRequest("key-2", `{"cep":"01001000"}`))
+		if rec.Code != want {
+			t.Errorf("request %d status = %d, want %d", i, rec.Code, want)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler called %d times, want 2, the 502 must not be stored", n)
+	}
+}
@@ -1,158 +1,672 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
 
 type Entrada struct {
 	CEP string `json:"cep"`
+	// Detail is the detail query param passed on to service_b, not part of the body
+	Detail string `json:"-"`
 }
 
+// cacheKey tells apart the responses with and without the detail of the CEP
+func (e Entrada) cacheKey() string {
+	if e.Detail == "" {
+		return e.CEP
+	}
+	return e.CEP + "|" + e.Detail
+}
+
+var (
+	ErrWeatherUnavailable = errors.New("weather service unavailable")
+	ErrWeatherTimeout     = errors.New("weather service upstream timeout")
+	// ErrWeatherUpstream is a 5xx answer of service_b, or a body that is
+	// not a weather response
+	ErrWeatherUpstream = errors.New("weather service failed")
+)
+
+// WeatherServiceError is a 4xx answer of service_b, with the code and message
+// of its ErrorResponse body, so the 404 and 422 reach the client unchanged
+type WeatherServiceError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *WeatherServiceError) Error() string {
+	return fmt.Sprintf("weather service answered %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// readyTimeout bounds the check of service_b done by /ready
+const readyTimeout = time.Second
+
+// weatherServiceTimeout is the default budget of a lookup in service_b,
+// retries included, the callers can change it with the X-Timeout-Ms header
+const weatherServiceTimeout = 5 * time.Second
+
 type WebServer struct {
-	Tracer trace.Tracer
+	Tracer     trace.Tracer
+	HTTPClient *http.Client
+	// ReadyClient checks service_b in /ready, without tracing the probes
+	ReadyClient *http.Client
+	Cache       *common.TTLCache[common.WeatherResponse]
+	// WeatherService is the base URL of service_b
+	WeatherService string
+	// PostalCodes validates the CEPs of the configured country
+	PostalCodes common.PostalCodeValidator
+	// AllowedCEPPrefixes restricts the CEPs served, empty allows every CEP
+	AllowedCEPPrefixes []string
+	// MaxRetries is how many times a failed call to service_b is retried
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	// BatchTimeout is the deadline of a whole batch, the CEPs not answered
+	// by then are reported as timeouts. 0 disables it
+	BatchTimeout time.Duration
+	// BatchConcurrency is how many CEPs of a batch or warm-up are looked up
+	// at the same time, bounding the calls a single request makes to service_b
+	BatchConcurrency int
+	// BatchMaxSize is the most CEPs a batch accepts, larger ones answer 400
+	BatchMaxSize int
+	// Idempotency keeps the POST responses by Idempotency-Key
+	Idempotency IdempotencyStore
+	// WarmupJobs keeps the warm-up jobs by id while their status can be queried
+	WarmupJobs *common.TTLCache[*warmupJob]
+	// JobsContext is cancelled on shutdown, the warm-up jobs run under it
+	// instead of the request that started them
+	JobsContext context.Context
+	warmups     sync.WaitGroup
 }
 
 // load env vars cfg
 func init() {
 	viper.AutomaticEnv()
+	viper.SetDefault("PORT", "8000")
+	viper.SetDefault("COUNTRY", common.CountryBR)
+	viper.SetDefault("SHUTDOWN_TIMEOUT", 10*time.Second)
+	viper.SetDefault("HTTP_MAX_IDLE_CONNS", common.DefaultHTTPPool.MaxIdleConns)
+	viper.SetDefault("HTTP_MAX_IDLE_CONNS_PER_HOST", common.DefaultHTTPPool.MaxIdleConnsPerHost)
+	viper.SetDefault("HTTP_IDLE_CONN_TIMEOUT", common.DefaultHTTPPool.IdleConnTimeout)
+	viper.SetDefault("HTTP_COMPRESSION", true)
+	viper.SetDefault("MAX_BODY_BYTES", 1<<20)
+	viper.SetDefault("OTEL_TRACES_SAMPLER_ARG", 1.0)
+	viper.SetDefault("SERVICE_VERSION", common.Version)
+	viper.SetDefault("DEPLOYMENT_ENVIRONMENT", "development")
+	viper.SetDefault("RESPONSE_CACHE_TTL", 60*time.Second)
+	viper.SetDefault("BATCH_TIMEOUT", 10*time.Second)
+	viper.SetDefault("BATCH_CONCURRENCY", 5)
+	viper.SetDefault("BATCH_MAX_SIZE", 100)
+	viper.SetDefault("IDEMPOTENCY_TTL", time.Hour)
+	viper.SetDefault("REQUEST_TIMEOUT", 8*time.Second)
+	viper.SetDefault("BATCH_REQUEST_TIMEOUT", 15*time.Second)
+	viper.SetDefault("RATE_LIMIT_RPS", 10)
+	viper.SetDefault("RATE_LIMIT_BURST", 20)
+	viper.SetDefault("WEATHER_SERVICE_MAX_RETRIES", 2)
+	viper.SetDefault("WEATHER_SERVICE_RETRY_DELAY", 100*time.Millisecond)
+	viper.SetDefault("WEATHER_SERVICE_MAX_TIMEOUT", 8*time.Second)
 }
 
 func main() {
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	// as flags da linha de comando sobrepõem as variáveis de ambiente
+	err := common.ParseFlags(os.Args[0], os.Args[1:], []common.Flag{
+		{Name: "port", Key: "PORT", Usage: "listen port"},
+		{Name: "weather-service", Key: "WEATHER_SERVICE", Usage: "base URL of service_b"},
+		{Name: "otlp-endpoint", Key: "OTEL_EXPORTER_OTLP_ENDPOINT", Usage: "OTLP collector endpoint"},
+		{Name: "log-level", Key: "LOG_LEVEL", Usage: "debug, info, warn or error"},
+	})
+	if errors.Is(err, pflag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	// o arquivo de configuração é lido antes do logger, ele pode definir o LOG_LEVEL
+	configFile, configErr := common.LoadConfigFile()
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	level, levelErr := common.ParseLogLevel(viper.GetString("LOG_LEVEL"))
+	logger := common.NewLogger(os.Stdout, level)
+	slog.SetDefault(logger)
+	if levelErr != nil {
+		logger.Warn(levelErr.Error())
+	}
+	if configErr != nil {
+		logger.Error(configErr.Error())
+		os.Exit(1)
+	}
+	if configFile != "" {
+		logger.Info("config file loaded", slog.String("file", configFile))
+	}
+
+	weatherService, err := common.BaseURL("WEATHER_SERVICE", viper.GetString("WEATHER_SERVICE"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	postalCodes, err := common.NewPostalCodeValidator(viper.GetString("COUNTRY"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	if viper.GetInt("BATCH_CONCURRENCY") < 1 || viper.GetInt("BATCH_MAX_SIZE") < 1 {
+		logger.Error("BATCH_CONCURRENCY and BATCH_MAX_SIZE must be at least 1",
+			slog.Int("batch_concurrency", viper.GetInt("BATCH_CONCURRENCY")),
+			slog.Int("batch_max_size", viper.GetInt("BATCH_MAX_SIZE")),
+		)
+		os.Exit(1)
+	}
+	if err := (common.RetryPolicy{BaseDelay: viper.GetDuration("WEATHER_SERVICE_RETRY_DELAY")}).Validate(); err != nil {
+		logger.Error("invalid WEATHER_SERVICE_RETRY_DELAY", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	samplingRatio, err := common.ParseSamplingRatio(viper.GetString("OTEL_TRACES_SAMPLER_ARG"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
-	shutdown, err := common.InitProvider("service_a", viper.GetString("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	providerConfig := common.ProviderConfig{
+		ServiceName:    "service_a",
+		ServiceVersion: viper.GetString("SERVICE_VERSION"),
+		Environment:    viper.GetString("DEPLOYMENT_ENVIRONMENT"),
+		Exporter:       viper.GetString("OTEL_TRACES_EXPORTER"),
+		CollectorURL:   viper.GetString("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		ZipkinURL:      viper.GetString("OTEL_EXPORTER_ZIPKIN_ENDPOINT"),
+		JaegerURL:      viper.GetString("OTEL_EXPORTER_JAEGER_ENDPOINT"),
+		Protocol:       viper.GetString("OTEL_EXPORTER_OTLP_PROTOCOL"),
+		SamplingRatio:  &samplingRatio,
+		Propagators:    viper.GetString("OTEL_PROPAGATORS"),
+		Disabled:       viper.GetBool("OTEL_SDK_DISABLED"),
+	}
+	shutdown, err := common.InitProvider(providerConfig)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	shutdownMetrics, err := common.InitMetricsProvider(providerConfig)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
-	defer func() {
-		if err := shutdown(ctx); err != nil {
-			log.Fatal("failed to shutdown TracerProvider: %w", err)
-		}
-	}()
 
 	tracer := otel.Tracer("microservice-tracer")
 
-	webserver := WebServer{
-		Tracer: tracer,
+	httpPool := common.HTTPPool{
+		MaxIdleConns:        viper.GetInt("HTTP_MAX_IDLE_CONNS"),
+		MaxIdleConnsPerHost: viper.GetInt("HTTP_MAX_IDLE_CONNS_PER_HOST"),
+		IdleConnTimeout:     viper.GetDuration("HTTP_IDLE_CONN_TIMEOUT"),
 	}
+	webserver := &WebServer{
+		Tracer:             tracer,
+		WeatherService:     weatherService,
+		PostalCodes:        postalCodes,
+		AllowedCEPPrefixes: common.CEPPrefixes(viper.GetString("CEP_ALLOWED_PREFIXES")),
+		// the otelhttp transport creates a client span for the call to
+		// service_b and injects the trace context in its headers
+		// o timeout do client não pode cortar um X-Timeout-Ms maior que o padrão
+		HTTPClient:       common.NewHTTPClient(max(weatherServiceTimeout, viper.GetDuration("WEATHER_SERVICE_MAX_TIMEOUT")), viper.GetString("HTTP_USER_AGENT"), httpPool),
+		ReadyClient:      &http.Client{Transport: common.NewHTTPTransport(readyTimeout, viper.GetString("HTTP_USER_AGENT"), httpPool)},
+		Cache:            common.NewTTLCache[common.WeatherResponse](viper.GetDuration("RESPONSE_CACHE_TTL")),
+		MaxRetries:       viper.GetInt("WEATHER_SERVICE_MAX_RETRIES"),
+		RetryBaseDelay:   viper.GetDuration("WEATHER_SERVICE_RETRY_DELAY"),
+		BatchTimeout:     viper.GetDuration("BATCH_TIMEOUT"),
+		BatchConcurrency: viper.GetInt("BATCH_CONCURRENCY"),
+		BatchMaxSize:     viper.GetInt("BATCH_MAX_SIZE"),
+		JobsContext:      ctx,
+	}
+	// as chaves de idempotência e os jobs quase nunca são lidos de novo, então
+	// os expirados são removidos periodicamente em vez de na leitura
+	idempotency := common.NewTTLCache[storedResponse](viper.GetDuration("IDEMPOTENCY_TTL"))
+	warmupJobs := common.NewTTLCache[*warmupJob](warmupJobTTL)
+	go func() {
+		for range time.Tick(time.Minute) {
+			idempotency.DeleteExpired()
+			warmupJobs.DeleteExpired()
+		}
+	}()
+	webserver.Idempotency = idempotency
+	webserver.WarmupJobs = warmupJobs
 
-	router := getRouter(webserver)
-
-	log.Println("Starting server on port", ":8000")
-	if err := http.ListenAndServe(":8000", router); err != nil {
-		log.Fatal(err)
+	addr, err := common.ListenAddr(viper.GetString("PORT"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	trustedProxies, err := common.ParseTrustedProxies(viper.GetString("TRUSTED_PROXIES"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
-	select {
-	case <-sigCh:
-		log.Println("Shutting down gracefully, CTRL+C pressed...")
-	case <-ctx.Done():
-		log.Println("Shutting down due to other reason...")
+	inFlight := &common.InFlight{}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: inFlight.Middleware(getRouter(webserver, logger, trustedProxies)),
 	}
 
+	go func() {
+		logger.Info("Starting server", slog.String("addr", srv.Addr))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("Shutting down gracefully...")
+
 	// Create a timeout context for the graceful shutdown
-	_, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), viper.GetDuration("SHUTDOWN_TIMEOUT"))
 	defer shutdownCancel()
+
+	// drain the in-flight requests before flushing the spans and metrics they produced
+	common.DrainServer(shutdownCtx, srv, inFlight, logger)
+	// o ctx já foi cancelado, os warm-ups em andamento param nos CEPs atuais
+	if err := webserver.WaitWarmups(shutdownCtx); err != nil {
+		logger.Error("failed to stop the warm-up jobs", slog.Any("error", err))
+	}
+	if err := shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shutdown TracerProvider", slog.Any("error", err))
+	}
+	if err := shutdownMetrics(shutdownCtx); err != nil {
+		logger.Error("failed to shutdown MeterProvider", slog.Any("error", err))
+	}
+	logger.Info("Server stopped")
 }
 
-func getRouter(ws WebServer) *chi.Mux {
+func getRouter(ws *WebServer, logger *slog.Logger, trustedProxies []netip.Prefix) *chi.Mux {
 	router := chi.NewRouter()
+	apiKeys := common.SplitList(viper.GetString("API_KEYS"))
 
 	router.Use(middleware.RequestID)
-	router.Use(middleware.RealIP)
+	router.Use(common.RealIP(trustedProxies))
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.Logger)
-	router.Use(middleware.Timeout(60 * time.Second))
-	router.Post("/", ws.handleRequest)
+
+	// probes are kept out of the request log and traces
+	router.Get("/health", common.HealthHandler)
+	router.Get("/ready", ws.handleReady)
+	router.Get("/version", common.VersionHandler)
+
+	router.Group(func(r chi.Router) {
+		r.Use(common.TracingAndMetrics(ws.Tracer))
+		r.Use(common.CorrelationHeaders)
+		r.Use(common.RequestLogger(logger))
+		r.Use(NewRateLimiter(viper.GetFloat64("RATE_LIMIT_RPS"), viper.GetInt("RATE_LIMIT_BURST")).Middleware)
+		r.Use(APIKeyAuth(apiKeys))
+		r.Use(LookupTimeout(viper.GetDuration("WEATHER_SERVICE_MAX_TIMEOUT")))
+		if viper.GetBool("HTTP_COMPRESSION") {
+			// gzip negociado pelo Accept-Encoding, apenas para as respostas JSON
+			r.Use(middleware.Compress(5, "application/json"))
+		}
+		r.Use(limitBody(viper.GetInt64("MAX_BODY_BYTES")))
+		// o prazo de cada rota cobre o orçamento das chamadas ao service_b
+		requestTimeout := common.Timeout(viper.GetDuration("REQUEST_TIMEOUT"), http.StatusGatewayTimeout)
+		r.With(requestTimeout, Idempotency(ws.Idempotency)).Post("/", ws.handleRequest)
+		r.With(requestTimeout).Get("/", ws.handleQuery)
+		r.With(common.Timeout(viper.GetDuration("BATCH_REQUEST_TIMEOUT"), http.StatusGatewayTimeout)).Post("/batch", ws.handleBatch)
+		r.With(RequireAPIKeys(apiKeys)).Post("/admin/warmup", ws.handleWarmup)
+		r.With(RequireAPIKeys(apiKeys)).Get("/admin/warmup/{id}", ws.handleWarmupStatus)
+	})
 	return router
 }
 
+// handleReady answers 200 while service_b answers its /health. The tracer
+// provider needs no check, the server only listens after it was initialized.
+func (ws *WebServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := common.CheckReachable(ctx, ws.ReadyClient, ws.WeatherService+"/health"); err != nil {
+		common.WriteHealth(w, http.StatusServiceUnavailable, "weather service unreachable")
+		return
+	}
+	common.WriteHealth(w, http.StatusOK, "")
+}
+
 func (ws *WebServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 
-	carrier := propagation.HeaderCarrier(r.Header)
+	// the propagated trace context was extracted by the tracing middleware
 	ctx := r.Context()
-	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
 
 	ctx, spanValidation := ws.Tracer.Start(ctx, "Validate inputs")
 
+	ctx = withTenant(ctx, r, spanValidation)
+
 	var entrada Entrada
-	if err := json.NewDecoder(r.Body).Decode(&entrada); err != nil {
-		http.Error(w, "payload inválido", http.StatusBadRequest)
+	if err := common.DecodeJSON(ctx, ws.Tracer, r.Body, &entrada); err != nil {
+		writeDecodeError(w, spanValidation, err)
+		return
+	}
+	version, err := common.ParseSchemaVersion(r)
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_version", err.Error())
 		spanValidation.RecordError(err)
-		spanValidation.SetStatus(codes.Error, "payload inválido")
+		spanValidation.SetStatus(codes.Error, err.Error())
 		spanValidation.End()
 		return
 	}
 
-	if !common.IsValidCEP(entrada.CEP) { // retorna o erro 422
-		http.Error(w, "invalid zipcode", http.StatusUnprocessableEntity)
-		spanValidation.SetStatus(codes.Error, "invalid zipcode")
+	entrada.Detail = r.URL.Query().Get("detail")
+	if response, ok := ws.lookupCEP(ctx, w, spanValidation, entrada, r.URL.Query().Get("units")); ok {
+		common.EncodeWeather(ctx, ws.Tracer, w, version, response)
+	}
+}
+
+// writeDecodeError answers 413 when the body is over the size limit and 400
+// for any other malformed payload, ending the validation span
+func writeDecodeError(w http.ResponseWriter, spanValidation trace.Span, err error) {
+	defer spanValidation.End()
+	spanValidation.RecordError(err)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		common.WriteJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "payload muito grande")
+		spanValidation.SetAttributes(attribute.Int64("http.request.body.limit", maxBytesErr.Limit))
+		spanValidation.SetStatus(codes.Error, "payload muito grande")
+		return
+	}
+	common.WriteJSONError(w, http.StatusBadRequest, "invalid_payload", "payload inválido")
+	spanValidation.SetStatus(codes.Error, "payload inválido")
+}
+
+// limitBody caps the request body at limit bytes, reading past it fails the
+// decoding with an *http.MaxBytesError
+func limitBody(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handleQuery is the GET version of handleRequest, for callers that can't
+// send a body: GET /?cep=01310100
+func (ws *WebServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+
+	// the propagated trace context was extracted by the tracing middleware
+	ctx := r.Context()
+
+	ctx, spanValidation := ws.Tracer.Start(ctx, "Validate inputs")
+
+	ctx = withTenant(ctx, r, spanValidation)
+
+	version, err := common.ParseSchemaVersion(r)
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_version", err.Error())
+		spanValidation.RecordError(err)
+		spanValidation.SetStatus(codes.Error, err.Error())
 		spanValidation.End()
 		return
 	}
 
+	if response, ok := ws.lookupCEP(ctx, w, spanValidation, Entrada{CEP: r.URL.Query().Get("cep"), Detail: r.URL.Query().Get("detail")}, r.URL.Query().Get("units")); ok {
+		ws.writeCacheable(ctx, w, r, version, response)
+	}
+}
+
+// writeCacheable answers the GET lookups with an ETag of the response and a
+// Cache-Control max-age matching the response cache ttl, so polling clients
+// get a 304 without body while the temperature didn't change
+func (ws *WebServer) writeCacheable(ctx context.Context, w http.ResponseWriter, r *http.Request, version string, response common.WeatherResponse) {
+	_, span := ws.Tracer.Start(ctx, "encode response")
+	body, err := json.Marshal(response.Versioned(version))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		common.WriteJSONError(w, http.StatusInternalServerError, "internal_error", "failed to encode response")
+		return
+	}
+	span.End()
+
+	// o ETag é do corpo, então já difere entre as versões
+	common.SetSchemaHeaders(w, version)
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ws.Cache.TTL().Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// etagMatches tells whether the If-None-Match header lists etag, weak
+// validators included
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCEP validates the CEP and looks up its temperature in the units,
+// ending the validation span once the input is checked. On failure the error
+// response is already written and ok is false.
+func (ws *WebServer) lookupCEP(ctx context.Context, w http.ResponseWriter, spanValidation trace.Span, entrada Entrada, rawUnits string) (response common.WeatherResponse, ok bool) {
+	// o service_b é sempre consultado com todas as unidades, que ficam em cache,
+	// e a resposta é filtrada aqui
+	units, err := common.ParseUnits(rawUnits)
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_units", err.Error())
+		spanValidation.RecordError(err)
+		spanValidation.SetStatus(codes.Error, err.Error())
+		spanValidation.End()
+		return response, false
+	}
+	entrada.Detail, err = common.ParseDetail(entrada.Detail)
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_detail", err.Error())
+		spanValidation.RecordError(err)
+		spanValidation.SetStatus(codes.Error, err.Error())
+		spanValidation.End()
+		return response, false
+	}
+
+	if strings.TrimSpace(entrada.CEP) == "" { // retorna o erro 422 quando o cep não foi informado
+		common.WriteJSONError(w, http.StatusUnprocessableEntity, "zipcode_required", "zipcode is required")
+		spanValidation.SetStatus(codes.Error, "zipcode is required")
+		spanValidation.End()
+		return response, false
+	}
+
+	cep, err := ws.PostalCodes.Normalize(entrada.CEP)
+	if err != nil { // retorna o erro 422
+		common.WriteJSONError(w, http.StatusUnprocessableEntity, "invalid_zipcode", "invalid zipcode")
+		spanValidation.RecordError(err)
+		spanValidation.SetStatus(codes.Error, "invalid zipcode")
+		spanValidation.End()
+		return response, false
+	}
+	if !common.CEPInAllowedRange(cep, ws.AllowedCEPPrefixes) { // retorna o erro 422 sem consultar o service_b
+		common.WriteJSONError(w, http.StatusUnprocessableEntity, "zipcode_not_allowed", common.ErrCEPNotAllowed.Error())
+		spanValidation.SetStatus(codes.Error, common.ErrCEPNotAllowed.Error())
+		spanValidation.End()
+		return response, false
+	}
+	entrada.CEP = cep
+
 	spanValidation.End()
 
-	ctx, span := ws.Tracer.Start(ctx, "Call to service_b")
+	callCtx, span := ws.Tracer.Start(ctx, "Call to service_b")
 	defer span.End()
 
-	response, err := ws.getTemperatura(ctx, entrada)
+	response, err = ws.getTemperaturaCached(callCtx, span, entrada)
 	if err != nil {
+		status, code, message := statusForError(err)
+		common.WriteJSONError(w, status, code, message)
+		recordCallError(span, err, status, message)
+		return response, false
+	}
+	return response.WithUnits(units), true
+}
 
-		http.Error(w, "CEP não encontrado", http.StatusNotFound)
+// withTenant adds the tenant from the X-Tenant-ID header to the baggage
+func withTenant(ctx context.Context, r *http.Request, span trace.Span) context.Context {
+	tenantID := r.Header.Get("X-Tenant-ID")
+	if tenantID == "" {
+		return ctx
+	}
+	tenantCtx, err := common.ContextWithTenant(ctx, tenantID)
+	if err != nil { // o tenant inválido não impede a consulta, apenas não é propagado
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "CEP não encontrado")
-		return
+		return ctx
+	}
+	span.SetAttributes(attribute.String(common.TenantBaggageKey, tenantID))
+	return tenantCtx
+}
+
+// statusForError maps the errors from getTemperatura to the response status,
+// error code and message. The 404 and 422 of service_b are passed through,
+// the connection errors, 5xx and unexpected answers are a 502 upstream_error.
+func statusForError(err error) (status int, code, message string) {
+	var serviceErr *WeatherServiceError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrWeatherTimeout):
+		return http.StatusGatewayTimeout, "timeout", "timeout waiting for weather service"
+	case errors.Is(err, ErrWeatherUnavailable):
+		return http.StatusServiceUnavailable, "weather_unavailable", "weather service unavailable"
+	case errors.As(err, &serviceErr) && serviceErr.Status == http.StatusNotFound:
+		return http.StatusNotFound, cmp.Or(serviceErr.Code, "zipcode_not_found"), cmp.Or(serviceErr.Message, "can not find zipcode")
+	case errors.As(err, &serviceErr) && serviceErr.Status == http.StatusUnprocessableEntity:
+		return http.StatusUnprocessableEntity, cmp.Or(serviceErr.Code, "invalid_zipcode"), cmp.Or(serviceErr.Message, "invalid zipcode")
+	default:
+		return http.StatusBadGateway, "upstream_error", "weather service request failed"
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+}
+
+func recordCallError(span trace.Span, err error, status int, message string) {
+	span.RecordError(err)
+	if status == http.StatusGatewayTimeout {
+		span.SetAttributes(attribute.String("error.type", "timeout"))
+	}
+	span.SetStatus(codes.Error, message)
+}
+
+// getTemperaturaCached answers from the cache when the CEP was looked up
+// recently, the temperature changes slowly so a short ttl is acceptable
+func (ws *WebServer) getTemperaturaCached(ctx context.Context, span trace.Span, entrada Entrada) (common.WeatherResponse, error) {
+	if response, ok := ws.Cache.GetContext(ctx, entrada.cacheKey()); ok {
+		span.SetAttributes(attribute.Bool("cache.hit", true), attribute.Bool("served_from_cache", true))
+		return response, nil
+	}
+	span.SetAttributes(attribute.Bool("cache.hit", false), attribute.Bool("served_from_cache", false))
+
+	response, err := ws.getTemperatura(ctx, entrada)
+	if err != nil {
+		return common.WeatherResponse{}, err
+	}
+	ws.Cache.SetContext(ctx, entrada.cacheKey(), response)
+	return response, nil
 }
 
 func (ws *WebServer) getTemperatura(tracectx context.Context, entrada Entrada) (common.WeatherResponse, error) {
+	common.RecordDeadline(tracectx, trace.SpanFromContext(tracectx))
 
-	ctx, cancel := context.WithTimeout(tracectx, 5000*time.Millisecond)
+	// the retries share the budget of the call, 5s unless the caller asked
+	// for another with X-Timeout-Ms
+	timeout := lookupTimeout(tracectx)
+	trace.SpanFromContext(tracectx).SetAttributes(attribute.Int64("weather.timeout_ms", timeout.Milliseconds()))
+	ctx, cancel := context.WithTimeout(tracectx, timeout)
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/weather?cep=%s", viper.GetString("WEATHER_SERVICE"), entrada.CEP), nil)
+	url := fmt.Sprintf("%s/weather?cep=%s", ws.WeatherService, entrada.CEP)
+	if entrada.Detail != "" {
+		url += "&detail=" + entrada.Detail
+	}
+
+	policy := common.RetryPolicy{MaxAttempts: max(ws.MaxRetries, 0) + 1, BaseDelay: ws.RetryBaseDelay}
+	var response common.WeatherResponse
+	err := common.DoWithRetry(ctx, func(ctx context.Context, attempt int) (retry bool, err error) {
+		response, retry, err = ws.getTemperaturaAttempt(ctx, url, attempt-1)
+		return retry, err
+	}, policy)
 	if err != nil {
 		return common.WeatherResponse{}, err
 	}
+	return response, nil
+}
 
-	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+// getTemperaturaAttempt does one call to service_b in its own span, telling
+// whether the failure is worth a retry: connection errors and 5xx are, the
+// 404 and 422 answers are not
+func (ws *WebServer) getTemperaturaAttempt(ctx context.Context, url string, attempt int) (response common.WeatherResponse, retry bool, err error) {
+	ctx, span := ws.Tracer.Start(ctx, "service_b request attempt",
+		trace.WithAttributes(attribute.Int("http.request.resend_count", attempt)),
+	)
+	defer span.End()
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}()
 
-	res, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return common.WeatherResponse{}, err
+		return common.WeatherResponse{}, false, err
+	}
+	common.LoggerFromContext(ctx).Debug("weather service request", slog.String("url", common.RedactURL(url)), slog.Int("attempt", attempt))
+
+	res, err := ws.HTTPClient.Do(req)
+	if err != nil { // o prazo estourado não é um erro de conexão
+		return common.WeatherResponse{}, ctx.Err() == nil, err
 	}
 	defer res.Body.Close()
+	// 503: o service_b ou as apis que ele consulta estão indisponíveis
+	if res.StatusCode == http.StatusServiceUnavailable {
+		return common.WeatherResponse{}, true, ErrWeatherUnavailable
+	}
+	if res.StatusCode == http.StatusGatewayTimeout { // o service_b não obteve resposta das apis a tempo
+		return common.WeatherResponse{}, true, ErrWeatherTimeout
+	}
+	if res.StatusCode >= http.StatusInternalServerError {
+		return common.WeatherResponse{}, true, fmt.Errorf("status %d from weather service: %w", res.StatusCode, ErrWeatherUpstream)
+	}
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return common.WeatherResponse{}, err
+		return common.WeatherResponse{}, false, err
 	}
-	var response common.WeatherResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return common.WeatherResponse{}, err
+	if res.StatusCode != http.StatusOK { // o corpo é um ErrorResponse, não a temperatura
+		var errorResponse common.ErrorResponse
+		json.Unmarshal(body, &errorResponse)
+		return common.WeatherResponse{}, false, &WeatherServiceError{Status: res.StatusCode, Code: errorResponse.Error.Code, Message: errorResponse.Error.Message}
 	}
-	return response, nil
+	if err := json.Unmarshal(body, &response); err != nil {
+		return common.WeatherResponse{}, false, fmt.Errorf("decoding weather service response: %w: %w", ErrWeatherUpstream, err)
+	}
+	return response, false, nil
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// newTestWebServer builds a WebServer calling the service_b at weatherService,
+// with a noop tracer and no retries
+func newTestWebServer(t *testing.T, weatherService string) *WebServer {
+	t.Helper()
+	postalCodes, err := common.NewPostalCodeValidator(common.CountryBR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &WebServer{
+		Tracer:           noop.NewTracerProvider().Tracer("test"),
+		HTTPClient:       &http.Client{Timeout: 5 * time.Second},
+		ReadyClient:      &http.Client{Timeout: time.Second},
+		Cache:            common.NewTTLCache[common.WeatherResponse](time.Minute),
+		WeatherService:   weatherService,
+		PostalCodes:      postalCodes,
+		BatchConcurrency: 2,
+		BatchMaxSize:     10,
+		Idempotency:      common.NewTTLCache[storedResponse](time.Minute),
+		WarmupJobs:       common.NewTTLCache[*warmupJob](time.Minute),
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"service_b 404", &WeatherServiceError{Status: http.StatusNotFound, Code: "temperature_not_found", Message: "can not find temperature"}, http.StatusNotFound, "temperature_not_found"},
+		{"service_b 422", &WeatherServiceError{Status: http.StatusUnprocessableEntity, Code: "invalid_zipcode", Message: "invalid zipcode"}, http.StatusUnprocessableEntity, "invalid_zipcode"},
+		{"service_b 404 without body", &WeatherServiceError{Status: http.StatusNotFound}, http.StatusNotFound, "zipcode_not_found"},
+		{"service_b 400", &WeatherServiceError{Status: http.StatusBadRequest, Code: "invalid_units"}, http.StatusBadGateway, "upstream_error"},
+		{"service_b 500", fmt.Errorf("status 500 from weather service: %w", ErrWeatherUpstream), http.StatusBadGateway, "upstream_error"},
+		{"service_b 503", ErrWeatherUnavailable, http.StatusServiceUnavailable, "weather_unavailable"},
+		{"service_b 504", ErrWeatherTimeout, http.StatusGatewayTimeout, "timeout"},
+		{"deadline", fmt.Errorf("attempt 2: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, "timeout"},
+		{"connection refused", errors.New("dial tcp 127.0.0.1:8080: connect: connection refused"), http.StatusBadGateway, "upstream_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code, _ := statusForError(tt.err)
+			if status != tt.wantStatus || code != tt.wantCode {
+				t.Errorf("statusForError() = %d %s, want %d %s", status, code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandleRequestAgainstServiceB(t *testing.T) {
+	var calls atomic.Int32
+	serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/weather" {
+			t.Errorf("service_b called on %s, want /weather", r.URL.Path)
+		}
+		switch r.URL.Query().Get("cep") {
+		case "01001000":
+			tempC, tempF, tempK := 25.0, 77.0, 298.2
+			json.NewEncoder(w).Encode(common.WeatherResponse{Cep: "01001000", City: "São Paulo", TempC: &tempC, TempF: &tempF, TempK: &tempK})
+		default:
+			common.WriteJSONError(w, http.StatusNotFound, "zipcode_not_found", "can not find zipcode")
+		}
+	}))
+	defer serviceB.Close()
+
+	router := getRouter(newTestWebServer(t, serviceB.URL), slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	tests := []struct {
+		name       string
+		cep        string
+		wantStatus int
+		wantCode   string
+		wantCalls  int32
+	}{
+		{"valid zipcode", "01001-000", http.StatusOK, "", 1},
+		{"zipcode not found", "99999999", http.StatusNotFound, "zipcode_not_found", 1},
+		{"invalid zipcode", "0100100", http.StatusUnprocessableEntity, "invalid_zipcode", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"cep":"`+tt.cep+`"}`)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("service_b called %d times, want %d", n, tt.wantCalls)
+			}
+			if tt.wantCode != "" {
+				var body common.ErrorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Error.Code != tt.wantCode {
+					t.Errorf("code = %q, want %q", body.Error.Code, tt.wantCode)
+				}
+				return
+			}
+			var body common.WeatherResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.City != "São Paulo" || body.TempC == nil || *body.TempC != 25 {
+				t.Errorf("body = %+v, want the service_b answer", body)
+			}
+		})
+	}
+}
+
+func TestHandleRequestInvalidPayload(t *testing.T) {
+	ws := newTestWebServer(t, "http://127.0.0.1:0")
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"empty object", `{}`, http.StatusUnprocessableEntity, "zipcode_required"},
+		{"empty cep", `{"cep":""}`, http.StatusUnprocessableEntity, "zipcode_required"},
+		{"not json", `cep=01001000`, http.StatusBadRequest, "invalid_payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ws.handleRequest(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+
+			var body common.ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus || body.Error.Code != tt.wantCode {
+				t.Errorf("handleRequest(%s) = %d %q, want %d %q", tt.body, rec.Code, body.Error.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	serviceB := httptest.NewServer(http.HandlerFunc(common.HealthHandler))
+	defer serviceB.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for url, want := range map[string]int{serviceB.URL: http.StatusOK, down.URL: http.StatusServiceUnavailable} {
+		rec := httptest.NewRecorder()
+		newTestWebServer(t, url).handleReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		if rec.Code != want {
+			t.Errorf("ready with service_b at %s = %d, want %d", url, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// clients idle for longer than this have their bucket discarded
+const rateLimitIdleTimeout = 3 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter keeps a token bucket per client IP
+type RateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		limit:     rate.Limit(requestsPerSecond),
+		burst:     burst,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// Middleware answers 429 with a Retry-After header to the clients that ran
+// out of tokens. It relies on common.RealIP for the client address.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservation := rl.limiter(clientIP(r)).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			common.WriteJSONError(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.Int("http.retry_after", retryAfter))
+			span.SetStatus(codes.Error, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rl *RateLimiter) limiter(ip string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > time.Minute {
+		for key, client := range rl.clients {
+			if now.Sub(client.lastSeen) > rateLimitIdleTimeout {
+				delete(rl.clients, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	client, ok := rl.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[ip] = client
+	}
+	client.lastSeen = now
+	return client.limiter
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// warmupJobTTL is how long the status of a warm-up job can be queried
+const warmupJobTTL = time.Hour
+
+// warmupJob is a background run of lookups seeding the caches
+type warmupJob struct {
+	id        string
+	total     int
+	completed atomic.Int64
+	failed    atomic.Int64
+	done      atomic.Bool
+	canceled  atomic.Bool
+}
+
+// WarmupStatus is the body of the warm-up responses
+type WarmupStatus struct {
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"` // running, done or canceled
+	Total     int    `json:"total"`
+	Completed int64  `json:"completed"`
+	Failed    int64  `json:"failed"`
+}
+
+func (j *warmupJob) status() WarmupStatus {
+	status := "running"
+	if j.canceled.Load() {
+		status = "canceled"
+	} else if j.done.Load() {
+		status = "done"
+	}
+	return WarmupStatus{JobID: j.id, Status: status, Total: j.total, Completed: j.completed.Load(), Failed: j.failed.Load()}
+}
+
+// handleWarmup looks up the CEPs in the background, seeding the response
+// cache of service_a and the city and temperature caches of service_b, and
+// answers 202 with the job id right away: POST /admin/warmup {"ceps": [...]}
+func (ws *WebServer) handleWarmup(w http.ResponseWriter, r *http.Request) {
+	ctx, spanValidation := ws.Tracer.Start(r.Context(), "Validate inputs")
+
+	var entrada BatchEntrada
+	if err := common.DecodeJSON(ctx, ws.Tracer, r.Body, &entrada); err != nil {
+		writeDecodeError(w, spanValidation, err)
+		return
+	}
+
+	spanValidation.SetAttributes(
+		attribute.Int("batch.size", len(entrada.CEPs)),
+		attribute.Int("batch.max_size", ws.BatchMaxSize),
+	)
+	if ws.batchTooLarge(w, spanValidation, len(entrada.CEPs)) {
+		spanValidation.End()
+		return
+	}
+
+	// o warm-up é uma operação administrativa, qualquer CEP inválido rejeita a lista inteira
+	var validation common.ValidationError
+	if len(entrada.CEPs) == 0 {
+		validation.Add("ceps", "", "zipcode_required", "zipcode is required")
+	}
+	for idx, rawCEP := range entrada.CEPs {
+		field := fmt.Sprintf("ceps[%d]", idx)
+		cep, err := ws.PostalCodes.Normalize(rawCEP)
+		if err != nil {
+			validation.Add(field, rawCEP, "invalid_zipcode", "invalid zipcode")
+			continue
+		}
+		if !common.CEPInAllowedRange(cep, ws.AllowedCEPPrefixes) {
+			validation.Add(field, cep, "zipcode_not_allowed", common.ErrCEPNotAllowed.Error())
+			continue
+		}
+		entrada.CEPs[idx] = cep
+	}
+	if validation.HasProblems() {
+		common.WriteValidationError(w, &validation)
+		spanValidation.RecordError(&validation)
+		spanValidation.SetStatus(codes.Error, validation.Error())
+		spanValidation.End()
+		return
+	}
+	spanValidation.End()
+
+	job := &warmupJob{id: newJobID(), total: len(entrada.CEPs)}
+	ws.WarmupJobs.Set(job.id, job)
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("warmup.job_id", job.id),
+		attribute.Int("warmup.size", job.total),
+	)
+
+	// o job sobrevive à requisição mas não ao servidor, o trace dele aponta
+	// para o da requisição
+	requestLink := trace.LinkFromContext(r.Context(), attribute.String("link.type", "warmup"))
+	jobsCtx := ws.JobsContext
+	if jobsCtx == nil {
+		jobsCtx = context.Background()
+	}
+	ws.warmups.Add(1)
+	go func() {
+		defer ws.warmups.Done()
+		ws.runWarmup(jobsCtx, requestLink, job, entrada.CEPs)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	common.EncodeJSON(ctx, ws.Tracer, w, job.status())
+}
+
+// handleWarmupStatus answers the progress of a warm-up job: GET /admin/warmup/{id}
+func (ws *WebServer) handleWarmupStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := ws.WarmupJobs.Get(chi.URLParam(r, "id"))
+	if !ok {
+		common.WriteJSONError(w, http.StatusNotFound, "job_not_found", "warm-up job not found")
+		trace.SpanFromContext(r.Context()).SetStatus(codes.Error, "warm-up job not found")
+		return
+	}
+	common.EncodeJSON(r.Context(), ws.Tracer, w, job.status())
+}
+
+// runWarmup looks up the CEPs on BatchConcurrency workers in its own trace,
+// stopping with the CEPs left unsent when ctx is cancelled
+func (ws *WebServer) runWarmup(ctx context.Context, requestLink trace.Link, job *warmupJob, ceps []string) {
+	ctx, span := ws.Tracer.Start(ctx, "warmup",
+		trace.WithNewRoot(),
+		trace.WithLinks(requestLink),
+		trace.WithAttributes(attribute.String("warmup.job_id", job.id), attribute.Int("warmup.size", job.total)),
+	)
+	defer span.End()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(ws.BatchConcurrency, len(ceps)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cep := range jobs {
+				callCtx, callSpan := ws.Tracer.Start(ctx, "Call to service_b", trace.WithAttributes(attribute.String("cep", cep)))
+				if _, err := ws.getTemperaturaCached(callCtx, callSpan, Entrada{CEP: cep}); err != nil {
+					status, _, message := statusForError(err)
+					recordCallError(callSpan, err, status, message)
+					job.failed.Add(1)
+				} else {
+					job.completed.Add(1)
+				}
+				callSpan.End()
+			}
+		}()
+	}
+feed:
+	for _, cep := range ceps {
+		select {
+		case jobs <- cep:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		job.canceled.Store(true)
+		span.SetStatus(codes.Error, "warm-up canceled")
+	}
+	job.done.Store(true)
+	span.SetAttributes(
+		attribute.Int64("warmup.completed", job.completed.Load()),
+		attribute.Int64("warmup.failed", job.failed.Load()),
+		attribute.Bool("warmup.canceled", job.canceled.Load()),
+	)
+}
+
+// WaitWarmups waits for the running warm-up jobs until ctx is done, so their
+// spans are ended before the tracer provider is shut down
+func (ws *WebServer) WaitWarmups(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		ws.warmups.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
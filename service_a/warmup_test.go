@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+)
+
+func TestWarmupRejectsOversizedList(t *testing.T) {
+	ws := newTestWebServer(t, "http://127.0.0.1:0")
+	ws.BatchMaxSize = 2
+
+	rec := httptest.NewRecorder()
+	ws.handleWarmup(rec, httptest.NewRequest(http.MethodPost, "/admin/warmup", strings.NewReader(`{"ceps":["01001000","20040030","30130010"]}`)))
+
+	var body common.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || body.Error.Code != "batch_too_large" {
+		t.Errorf("warmup = %d %q, want %d batch_too_large", rec.Code, body.Error.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRequireAPIKeys(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name string
+		keys []string
+		want int
+	}{
+		{"no keys configured", nil, http.StatusForbidden},
+		{"keys configured", []string{"secret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			RequireAPIKeys(tt.keys)(ok).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/warmup", nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarmupStopsOnShutdown(t *testing.T) {
+	// o service_b só responde quando a chamada é cancelada
+	serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer serviceB.Close()
+
+	ws := newTestWebServer(t, serviceB.URL)
+	jobsCtx, cancel := context.WithCancel(context.Background())
+	ws.JobsContext = jobsCtx
+
+	rec := httptest.NewRecorder()
+	ws.handleWarmup(rec, httptest.NewRequest(http.MethodPost, "/admin/warmup", strings.NewReader(`{"ceps":["01001000","20040030","30130010","40010000"]}`)))
+	var status WarmupStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("warmup = %d, %v, want %d", rec.Code, err, http.StatusAccepted)
+	}
+
+	cancel()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer waitCancel()
+	if err := ws.WaitWarmups(waitCtx); err != nil {
+		t.Fatalf("WaitWarmups() = %v, the job kept running after the shutdown", err)
+	}
+
+	job, _ := ws.WarmupJobs.Get(status.JobID)
+	got := job.status()
+	if got.Status != "canceled" || got.Completed != 0 || got.Completed+got.Failed >= int64(got.Total) {
+		t.Errorf("job = %+v, want canceled before looking up every CEP", got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker opens after a number of consecutive failures and fast-fails
+// every call until openTimeout has elapsed, when a single trial call is let
+// through to decide whether to close it again
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	failureThreshold int
+	openTimeout      time.Duration
+	state            string
+	failures         int
+	openedAt         time.Time
+	probing          bool
+}
+
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		state:            BreakerClosed,
+	}
+}
+
+func (b *CircuitBreaker) Execute(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	// a call cancelled by the caller says nothing about the upstream health
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil || isClientError(err) {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.failureThreshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// isClientError reports the answers of a healthy upstream to a bad request,
+// like an unknown city or a 4xx, which must not open the circuit. A 429 still
+// counts, the upstream is asking to back off.
+func isClientError(err error) bool {
+	if errors.Is(err, ErrCityNotFound) {
+		return true
+	}
+	status := 0
+	var apiErr *WeatherAPIError
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.Status
+	case errors.As(err, &statusErr):
+		status = statusErr.StatusCode
+	}
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
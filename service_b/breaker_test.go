@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantOpen bool
+	}{
+		{"city not found", fmt.Errorf("city %q: %w: %w", "Xyz", ErrCityNotFound, &WeatherAPIError{Code: weatherAPINoLocationFound, Status: http.StatusBadRequest}), false},
+		{"weatherapi 400", &WeatherAPIError{Code: 1003, Message: "Parameter q is missing.", Status: http.StatusBadRequest}, false},
+		{"open-meteo 404", fmt.Errorf("geocoding: %w", &StatusError{StatusCode: http.StatusNotFound}), false},
+		{"weatherapi 429", &WeatherAPIError{Code: 2007, Status: http.StatusTooManyRequests}, true},
+		{"upstream 500", &StatusError{StatusCode: http.StatusInternalServerError}, true},
+		{"transport error", errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := NewCircuitBreaker(3, time.Minute)
+			for i := 0; i < 5; i++ {
+				breaker.Execute(func() error { return tt.err })
+			}
+			if open := breaker.State() == BreakerOpen; open != tt.wantOpen {
+				t.Errorf("state = %s after 5 calls, want open %v", breaker.State(), tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerClientErrorClosesHalfOpen(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Millisecond)
+	breaker.Execute(func() error { return errors.New("connection refused") })
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("state = %s, want open", breaker.State())
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// a cidade desconhecida prova que o upstream voltou a responder
+	breaker.Execute(func() error { return ErrCityNotFound })
+	if breaker.State() != BreakerClosed {
+		t.Errorf("state = %s after a not found trial call, want closed", breaker.State())
+	}
+}
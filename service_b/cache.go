@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+)
+
+type CityCache interface {
+	GetContext(ctx context.Context, cep string) (Location, bool)
+	SetContext(ctx context.Context, cep string, location Location)
+}
+
+func NewMemoryCityCache(ttl time.Duration) *common.TTLCache[Location] {
+	return common.NewTTLCache[Location](ttl)
+}
+
+// temperatureReading is the last successful temperature of a city
+type temperatureReading struct {
+	TempC       float64
+	Source      string
+	RetrievedAt time.Time
+	ObservedAt  time.Time
+}
+
+type TemperatureCache interface {
+	GetContext(ctx context.Context, city string) (temperatureReading, bool)
+	SetContext(ctx context.Context, city string, reading temperatureReading)
+}
+
+// NewMemoryTemperatureCache keeps the readings for maxAge, the oldest
+// temperature that can still be served when the providers fail
+func NewMemoryTemperatureCache(maxAge time.Duration) *common.TTLCache[temperatureReading] {
+	return common.NewTTLCache[temperatureReading](maxAge)
+}
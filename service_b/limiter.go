@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrUpstreamBusy = errors.New("too many in-flight upstream calls")
+
+// ConcurrencyLimiter bounds the in-flight upstream calls with a semaphore, a
+// call waits up to maxWait for a free slot before failing with ErrUpstreamBusy
+type ConcurrencyLimiter struct {
+	slots   chan struct{}
+	maxWait time.Duration
+}
+
+func NewConcurrencyLimiter(maxInFlight int, maxWait time.Duration) *ConcurrencyLimiter {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &ConcurrencyLimiter{
+		slots:   make(chan struct{}, maxInFlight),
+		maxWait: maxWait,
+	}
+}
+
+// Acquire takes a slot, recording the time waited for it on the span in ctx
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	start := time.Now()
+	defer func() {
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Int64("upstream.queue_wait_ms", time.Since(start).Milliseconds()),
+		)
+	}()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-timer.C:
+		return nil, ErrUpstreamBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limitedApiClient runs the calls of the wrapped client under the limiter
+type limitedApiClient struct {
+	IApiClient
+	limiter *ConcurrencyLimiter
+}
+
+func NewLimitedClient(client IApiClient, limiter *ConcurrencyLimiter) IApiClient {
+	return &limitedApiClient{IApiClient: client, limiter: limiter}
+}
+
+func (c *limitedApiClient) getCityByCEP(ctx context.Context, cep string) (Location, error) {
+	release, err := c.limiter.Acquire(ctx)
+	if err != nil {
+		return Location{}, err
+	}
+	defer release()
+	return c.IApiClient.getCityByCEP(ctx, cep)
+}
+
+func (c *limitedApiClient) getTemperatureByCity(ctx context.Context, city string) (Observation, string, error) {
+	release, err := c.limiter.Acquire(ctx)
+	if err != nil {
+		return Observation{}, "", err
+	}
+	defer release()
+	return c.IApiClient.getTemperatureByCity(ctx, city)
+}
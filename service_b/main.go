@@ -2,207 +2,769 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
 
-type ViaCEPResponse struct {
-	Localidade string `json:"localidade,omitempty"`
-	Erro       bool   `json:"erro,omitempty"`
-}
-
-type WeatherAPIResponse struct {
-	Current struct {
-		TempC float64 `json:"temp_c"`
-	} `json:"current"`
+// ErrCEPNotFound is returned when the postal API answers that the CEP doesn't exist
+var ErrCEPNotFound = errors.New("zipcode not found")
+
+// Location is where a CEP is, the state tells apart cities with the same name.
+// Neighborhood and Street are empty when the postal API doesn't have them,
+// like the CEPs of a whole city
+type Location struct {
+	City         string
+	State        string
+	Neighborhood string
+	Street       string
 }
 
 type IApiClient interface {
-	getCityByCEP(cep string) (string, error)
-	getTemperatureByCity(cep string) (float64, error)
+	getCityByCEP(ctx context.Context, cep string) (Location, error)
+	getTemperatureByCity(ctx context.Context, city string) (observation Observation, source string, err error)
 }
 
 type ApiClient struct {
-	httpGet        func(url string) (resp *http.Response, err error)
-	wheatherApiKey string
+	httpClient       *http.Client
+	weatherProviders []guardedProvider
+	tracer           trace.Tracer
+	cityResolver     CityResolver
+	upstreamTimeout  time.Duration
+	retryPolicy      common.RetryPolicy
+	// metrics records each weather provider call under the provider name
+	metrics *Metrics
 }
 
 func NewClient(
-	httpGet func(url string) (resp *http.Response, err error),
-	wheatherApiKey string,
-) *ApiClient {
-	return &ApiClient{
-		httpGet:        httpGet,
-		wheatherApiKey: wheatherApiKey,
+	httpClient *http.Client,
+	weatherProviders []guardedProvider,
+	tracer trace.Tracer,
+	postalProvider string,
+	postalBaseURL string,
+	postalCodes common.PostalCodeValidator,
+	upstreamTimeout time.Duration,
+	maxAttempts int,
+	metrics *Metrics,
+) (*ApiClient, error) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if httpClient == nil {
+		httpClient = common.NewHTTPClient(defaultHTTPTimeout, common.DefaultUserAgent(), common.DefaultHTTPPool)
 	}
+	c := &ApiClient{
+		httpClient:       httpClient,
+		weatherProviders: weatherProviders,
+		tracer:           tracer,
+		upstreamTimeout:  upstreamTimeout,
+		retryPolicy:      common.RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: 100 * time.Millisecond},
+		metrics:          metrics,
+	}
+	cityResolver, err := newCityResolver(postalProvider, postalBaseURL, postalCodes, c.getWithRetry)
+	if err != nil {
+		return nil, err
+	}
+	c.cityResolver = cityResolver
+	return c, nil
 }
 
+const (
+	defaultHTTPTimeout     = 5 * time.Second
+	defaultUpstreamTimeout = 3 * time.Second
+)
+
 type WeatherHandler struct {
-	apiClient IApiClient
-	tracer    trace.Tracer
+	apiClient    IApiClient
+	cityCache    CityCache
+	lastReadings TemperatureCache
+	postalCodes  common.PostalCodeValidator
+	// allowedPrefixes restricts the CEPs served, empty allows every CEP
+	allowedPrefixes []string
+	// bounds rejects the implausible readings of the providers
+	bounds  common.TemperatureBounds
+	tracer  trace.Tracer
+	metrics *Metrics
 }
 
-func NewWeatherHandler(apiClient IApiClient, tracer trace.Tracer) *WeatherHandler {
+func NewWeatherHandler(
+	apiClient IApiClient,
+	cityCache CityCache,
+	lastReadings TemperatureCache,
+	postalCodes common.PostalCodeValidator,
+	allowedPrefixes []string,
+	bounds common.TemperatureBounds,
+	tracer trace.Tracer,
+	metrics *Metrics,
+) *WeatherHandler {
 	return &WeatherHandler{
-		apiClient: apiClient,
-		tracer:    tracer,
+		apiClient:       apiClient,
+		cityCache:       cityCache,
+		lastReadings:    lastReadings,
+		postalCodes:     postalCodes,
+		allowedPrefixes: allowedPrefixes,
+		bounds:          bounds,
+		tracer:          tracer,
+		metrics:         metrics,
 	}
 }
 
 // load env vars cfg
 func init() {
 	viper.AutomaticEnv()
+	viper.SetDefault("PORT", "8080")
+	viper.SetDefault("COUNTRY", common.CountryBR)
+	viper.SetDefault("SHUTDOWN_TIMEOUT", 10*time.Second)
+	viper.SetDefault("REQUEST_TIMEOUT", 60*time.Second)
+	viper.SetDefault("HTTP_MAX_IDLE_CONNS", common.DefaultHTTPPool.MaxIdleConns)
+	viper.SetDefault("HTTP_MAX_IDLE_CONNS_PER_HOST", common.DefaultHTTPPool.MaxIdleConnsPerHost)
+	viper.SetDefault("HTTP_IDLE_CONN_TIMEOUT", common.DefaultHTTPPool.IdleConnTimeout)
+	viper.SetDefault("READY_GATE", true)
+	viper.SetDefault("READY_GATE_TIMEOUT", 30*time.Second)
+	viper.SetDefault("HTTP_COMPRESSION", true)
+	viper.SetDefault("PPROF_ADDR", "localhost:6060")
+	viper.SetDefault("OTEL_TRACES_SAMPLER_ARG", 1.0)
+	viper.SetDefault("SERVICE_VERSION", common.Version)
+	viper.SetDefault("DEPLOYMENT_ENVIRONMENT", "development")
+	viper.SetDefault("VIACEP_MAX_ATTEMPTS", 3)
+	viper.SetDefault("HTTP_CLIENT_TIMEOUT", defaultHTTPTimeout)
+	viper.SetDefault("UPSTREAM_TIMEOUT", defaultUpstreamTimeout)
+	viper.SetDefault("MAX_INFLIGHT_UPSTREAM", 100)
+	viper.SetDefault("UPSTREAM_QUEUE_TIMEOUT", 500*time.Millisecond)
+	viper.SetDefault("CITY_CACHE_TTL", 24*time.Hour)
+	viper.SetDefault("STALE_TEMPERATURE_MAX_AGE", time.Hour)
+	viper.SetDefault("TEMPERATURE_MIN_C", common.DefaultTemperatureBounds.MinC)
+	viper.SetDefault("TEMPERATURE_MAX_C", common.DefaultTemperatureBounds.MaxC)
+	viper.SetDefault("WEATHERAPI_BREAKER_FAILURES", 5)
+	viper.SetDefault("WEATHERAPI_BREAKER_OPEN_TIMEOUT", 30*time.Second)
+	viper.SetDefault("WEATHER_PROVIDERS", SourceWeatherAPI+","+SourceOpenMeteo)
+	viper.SetDefault("POSTAL_PROVIDER", PostalProviderViaCEP)
+	viper.SetDefault("VIACEP_BASE_URL", "https://viacep.com.br")
+	viper.SetDefault("WEATHERAPI_BASE_URL", "https://api.weatherapi.com")
 }
 
 func main() {
 
+	// as flags da linha de comando sobrepõem as variáveis de ambiente
+	err := common.ParseFlags(os.Args[0], os.Args[1:], []common.Flag{
+		{Name: "port", Key: "PORT", Usage: "listen port"},
+		{Name: "weatherapi-key", Key: "WEATHERAPI_KEY", Usage: "weatherapi key"},
+		{Name: "otlp-endpoint", Key: "OTEL_EXPORTER_OTLP_ENDPOINT", Usage: "OTLP collector endpoint"},
+		{Name: "log-level", Key: "LOG_LEVEL", Usage: "debug, info, warn or error"},
+	})
+	if errors.Is(err, pflag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	// o arquivo de configuração é lido antes do logger, ele pode definir o LOG_LEVEL
+	configFile, configErr := common.LoadConfigFile()
+
+	level, levelErr := common.ParseLogLevel(viper.GetString("LOG_LEVEL"))
+	logger := common.NewLogger(os.Stdout, level)
+	slog.SetDefault(logger)
+	if levelErr != nil {
+		logger.Warn(levelErr.Error())
+	}
+	if configErr != nil {
+		logger.Error(configErr.Error())
+		os.Exit(1)
+	}
+	if configFile != "" {
+		logger.Info("config file loaded", slog.String("file", configFile))
+	}
+
+	mockUpstream := viper.GetBool("MOCK_UPSTREAM")
 	apiKey := viper.GetString("WEATHERAPI_KEY")
-	if apiKey == "" {
-		log.Fatalf("weatherapi key not set")
+	if apiKey == "" && !mockUpstream {
+		logger.Error("weatherapi key not set")
+		os.Exit(1)
 	}
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	samplingRatio, err := common.ParseSamplingRatio(viper.GetString("OTEL_TRACES_SAMPLER_ARG"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
-	shutdown, err := common.InitProvider("service_b", viper.GetString("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	providerConfig := common.ProviderConfig{
+		ServiceName:    "service_b",
+		ServiceVersion: viper.GetString("SERVICE_VERSION"),
+		Environment:    viper.GetString("DEPLOYMENT_ENVIRONMENT"),
+		Exporter:       viper.GetString("OTEL_TRACES_EXPORTER"),
+		CollectorURL:   viper.GetString("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		ZipkinURL:      viper.GetString("OTEL_EXPORTER_ZIPKIN_ENDPOINT"),
+		JaegerURL:      viper.GetString("OTEL_EXPORTER_JAEGER_ENDPOINT"),
+		Protocol:       viper.GetString("OTEL_EXPORTER_OTLP_PROTOCOL"),
+		SamplingRatio:  &samplingRatio,
+		Propagators:    viper.GetString("OTEL_PROPAGATORS"),
+		Disabled:       viper.GetBool("OTEL_SDK_DISABLED"),
+	}
+	shutdown, err := common.InitProvider(providerConfig)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
-	defer func() {
-		if err := shutdown(ctx); err != nil {
-			log.Fatal("failed to shutdown TracerProvider: %w", err)
+	shutdownMetrics, err := common.InitMetricsProvider(providerConfig)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	tracer := otel.Tracer("microservice-tracer")
+
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry)
+
+	postalCodes, err := common.NewPostalCodeValidator(viper.GetString("COUNTRY"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	var client IApiClient
+	httpPool := common.HTTPPool{
+		MaxIdleConns:        viper.GetInt("HTTP_MAX_IDLE_CONNS"),
+		MaxIdleConnsPerHost: viper.GetInt("HTTP_MAX_IDLE_CONNS_PER_HOST"),
+		IdleConnTimeout:     viper.GetDuration("HTTP_IDLE_CONN_TIMEOUT"),
+	}
+	// as verificações de prontidão não geram spans
+	readyClient := &http.Client{Transport: common.NewHTTPTransport(viper.GetDuration("HTTP_CLIENT_TIMEOUT"), viper.GetString("HTTP_USER_AGENT"), httpPool)}
+	var gate *readinessGate
+	if viper.GetBool("READY_GATE") && !mockUpstream {
+		gate = newReadinessGate(readyClient, viper.GetString("VIACEP_BASE_URL"), viper.GetString("WEATHERAPI_BASE_URL"), apiKey)
+		go gate.run(ctx, logger, viper.GetDuration("READY_GATE_TIMEOUT"))
+	}
+	ready := readyHandler(apiKey, viper.GetBool("READY_CHECK_VIACEP"), viper.GetString("VIACEP_BASE_URL"), readyClient, gate)
+	if mockUpstream {
+		logger.Warn("MOCK_UPSTREAM enabled, answering fake cities and temperatures")
+		client = NewMockClient(tracer)
+		ready = common.HealthHandler
+	} else {
+		httpClient := common.NewHTTPClient(viper.GetDuration("HTTP_CLIENT_TIMEOUT"), viper.GetString("HTTP_USER_AGENT"), httpPool)
+		weatherProviders, err := NewWeatherProviders(viper.GetString("WEATHER_PROVIDERS"), httpClient, viper.GetString("WEATHERAPI_BASE_URL"), apiKey, func() *CircuitBreaker {
+			return NewCircuitBreaker(
+				viper.GetInt("WEATHERAPI_BREAKER_FAILURES"),
+				viper.GetDuration("WEATHERAPI_BREAKER_OPEN_TIMEOUT"),
+			)
+		})
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		client, err = NewClient(httpClient, weatherProviders, tracer, viper.GetString("POSTAL_PROVIDER"), viper.GetString("VIACEP_BASE_URL"), postalCodes, viper.GetDuration("UPSTREAM_TIMEOUT"), viper.GetInt("VIACEP_MAX_ATTEMPTS"), metrics)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	client = NewInstrumentedClient(client, metrics)
+	if maxInFlight := viper.GetInt("MAX_INFLIGHT_UPSTREAM"); maxInFlight > 0 {
+		client = NewLimitedClient(client, NewConcurrencyLimiter(maxInFlight, viper.GetDuration("UPSTREAM_QUEUE_TIMEOUT")))
+	}
+	cityCache := NewMemoryCityCache(viper.GetDuration("CITY_CACHE_TTL"))
+	lastReadings := NewMemoryTemperatureCache(viper.GetDuration("STALE_TEMPERATURE_MAX_AGE"))
+	bounds := common.TemperatureBounds{MinC: viper.GetFloat64("TEMPERATURE_MIN_C"), MaxC: viper.GetFloat64("TEMPERATURE_MAX_C")}
+	if bounds.MinC >= bounds.MaxC {
+		logger.Error(fmt.Sprintf("invalid temperature bounds: TEMPERATURE_MIN_C %v must be below TEMPERATURE_MAX_C %v", bounds.MinC, bounds.MaxC))
+		os.Exit(1)
+	}
+	wh := NewWeatherHandler(client, cityCache, lastReadings, postalCodes, common.CEPPrefixes(viper.GetString("CEP_ALLOWED_PREFIXES")), bounds, tracer, metrics)
+
+	addr, err := common.ListenAddr(viper.GetString("PORT"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	trustedProxies, err := common.ParseTrustedProxies(viper.GetString("TRUSTED_PROXIES"))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	inFlight := &common.InFlight{}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: inFlight.Middleware(getRouter(wh, logger, registry, ready, trustedProxies)),
+	}
+
+	go func() {
+		logger.Info("Listening", slog.String("addr", srv.Addr))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error(err.Error())
+			os.Exit(1)
 		}
 	}()
 
-	tracer := otel.Tracer("microservice-tracer")
+	// o pprof fica desligado por padrão e, ligado, escuta apenas em localhost
+	var pprofSrv *http.Server
+	if viper.GetBool("ENABLE_PPROF") {
+		pprofSrv = newPprofServer(viper.GetString("PPROF_ADDR"))
+		startPprof(logger, pprofSrv)
+	}
+
+	<-ctx.Done()
+	logger.Info("Shutting down gracefully...")
+
+	// Create a timeout context for the graceful shutdown
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), viper.GetDuration("SHUTDOWN_TIMEOUT"))
+	defer shutdownCancel()
 
-	client := NewClient(http.Get, apiKey)
-	wh := NewWeatherHandler(client, tracer)
+	// drain the in-flight requests before flushing the spans and metrics they produced
+	common.DrainServer(shutdownCtx, srv, inFlight, logger)
+	if pprofSrv != nil {
+		pprofSrv.Close()
+	}
+	if err := shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shutdown TracerProvider", slog.Any("error", err))
+	}
+	if err := shutdownMetrics(shutdownCtx); err != nil {
+		logger.Error("failed to shutdown MeterProvider", slog.Any("error", err))
+	}
+	logger.Info("Server stopped")
+}
 
+// getRouter wires the handler with the middlewares and probes, the handler
+// dependencies are injected so it can run against fake upstreams
+func getRouter(wh *WeatherHandler, logger *slog.Logger, registry *prometheus.Registry, ready http.HandlerFunc, trustedProxies []netip.Prefix) *chi.Mux {
 	router := chi.NewRouter()
 
 	router.Use(middleware.RequestID)
-	router.Use(middleware.RealIP)
+	router.Use(common.RealIP(trustedProxies))
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.Logger)
-	router.Use(middleware.Timeout(60 * time.Second))
-	router.HandleFunc("/weather", wh.weatherHandler)
-	log.Printf("Listening on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", router))
 
-	select {
-	case <-sigCh:
-		log.Println("Shutting down gracefully, CTRL+C pressed...")
-	case <-ctx.Done():
-		log.Println("Shutting down due to other reason...")
-	}
-
-	// Create a timeout context for the graceful shutdown
-	_, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownCancel()
+	// probes and metric scrapes are kept out of the request log and traces
+	router.Get("/health", common.HealthHandler)
+	router.Get("/ready", ready)
+	router.Get("/version", common.VersionHandler)
+	router.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	router.Group(func(r chi.Router) {
+		r.Use(common.TracingAndMetrics(wh.tracer))
+		r.Use(common.CorrelationHeaders)
+		r.Use(common.RequestLogger(logger))
+		if viper.GetBool("HTTP_COMPRESSION") {
+			// gzip negociado pelo Accept-Encoding, apenas para as respostas JSON
+			r.Use(middleware.Compress(5, "application/json"))
+		}
+		r.Use(common.Timeout(viper.GetDuration("REQUEST_TIMEOUT"), http.StatusGatewayTimeout))
+		r.HandleFunc("/weather", wh.weatherHandler)
+	})
+	return router
+}
 
+// readyHandler reports the service as ready when the weatherapi key is set, the
+// gate, when given, is open and, if checkViaCEP is enabled, ViaCEP answers
+// within one second
+func readyHandler(apiKey string, checkViaCEP bool, viaCEPBaseURL string, client *http.Client, gate *readinessGate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKey == "" {
+			common.WriteHealth(w, http.StatusServiceUnavailable, "weatherapi key not set")
+			return
+		}
+		if gate != nil && !gate.Open() {
+			common.WriteHealth(w, http.StatusServiceUnavailable, "waiting for the first upstream check")
+			return
+		}
+		if checkViaCEP {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+			defer cancel()
+			if err := common.CheckReachable(ctx, client, strings.TrimSuffix(viaCEPBaseURL, "/")+"/ws/01001000/json/"); err != nil {
+				common.WriteHealth(w, http.StatusServiceUnavailable, "viacep unreachable")
+				return
+			}
+		}
+		common.WriteHealth(w, http.StatusOK, "")
+	}
 }
 
 func (wh *WeatherHandler) weatherHandler(w http.ResponseWriter, r *http.Request) {
 
-	carrier := propagation.HeaderCarrier(r.Header)
+	start := time.Now()
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	w = ww
+	defer func() {
+		wh.metrics.observeRequest(ww.Status(), time.Since(start))
+	}()
+
+	// the propagated trace context was extracted by the tracing middleware
 	ctx := r.Context()
-	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
 
 	ctx, span := wh.tracer.Start(ctx, "Validate inputs")
+	if tenantID := common.TenantFromContext(ctx); tenantID != "" {
+		span.SetAttributes(attribute.String(common.TenantBaggageKey, tenantID))
+	}
 
-	cep := r.URL.Query().Get("cep")
+	units, err := common.ParseUnits(r.URL.Query().Get("units"))
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_units", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return
+	}
+	version, err := common.ParseSchemaVersion(r)
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_version", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return
+	}
+	detail, err := common.ParseDetail(r.URL.Query().Get("detail"))
+	if err != nil { // retorna o erro 400
+		common.WriteJSONError(w, http.StatusBadRequest, "invalid_detail", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return
+	}
 
-	if !common.IsValidCEP(cep) { // retorna o erro 422
-		http.Error(w, "invalid zipcode", http.StatusUnprocessableEntity)
+	cep, err := wh.postalCodes.Normalize(r.URL.Query().Get("cep"))
+	if err != nil { // retorna o erro 422
+		common.WriteJSONError(w, http.StatusUnprocessableEntity, "invalid_zipcode", "invalid zipcode")
+		wh.metrics.invalidZipcodes.Inc()
+		span.RecordError(err)
 		span.SetStatus(codes.Error, "invalid zipcode")
 		span.End()
 		return
 	}
+	if !common.CEPInAllowedRange(cep, wh.allowedPrefixes) { // retorna o erro 422 sem gastar a cota da viacep
+		common.WriteJSONError(w, http.StatusUnprocessableEntity, "zipcode_not_allowed", common.ErrCEPNotAllowed.Error())
+		span.SetStatus(codes.Error, common.ErrCEPNotAllowed.Error())
+		span.End()
+		return
+	}
 
+	// cep e cidade não identificam a pessoa, podem ir para o trace
+	span.SetAttributes(attribute.String("cep", cep))
 	span.End()
 
 	ctx, span = wh.tracer.Start(ctx, "Get City from Zipcode")
 
-	city, err := wh.apiClient.getCityByCEP(cep)
-	if err != nil { // retorna o erro 404
-		http.Error(w, "can not find zipcode", http.StatusNotFound)
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "can not find zipcode")
-		span.End()
-		return
+	location, cached := wh.cityCache.GetContext(ctx, cep)
+	span.SetAttributes(attribute.Bool("cache.hit", cached), attribute.Bool("served_from_cache", cached))
+	if !cached {
+		location, err = wh.apiClient.getCityByCEP(ctx, cep)
+		if errors.Is(err, ErrUpstreamBusy) {
+			writeBusy(w, span, err)
+			span.End()
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) { // retorna 504 quando a viacep não responde a tempo
+			common.WriteJSONError(w, http.StatusGatewayTimeout, "timeout", "timeout waiting for zipcode")
+			wh.metrics.upstreamFailed("viacep")
+			recordUpstreamError(span, err, "timeout waiting for zipcode")
+			span.End()
+			return
+		}
+		var rateLimited *RateLimitedError
+		if errors.As(err, &rateLimited) { // retorna 503 quando a viacep limitou as consultas
+			retryAfter := rateLimited.RetryAfter
+			if retryAfter == "" {
+				retryAfter = defaultRateLimitRetryAfter
+			}
+			w.Header().Set("Retry-After", retryAfter)
+			common.WriteJSONError(w, http.StatusServiceUnavailable, "upstream_rate_limited", "zipcode lookup rate limited, try again later")
+			wh.metrics.upstreamFailed("viacep")
+			span.RecordError(err)
+			span.SetAttributes(attribute.String("error.type", "rate_limited"), attribute.String("http.retry_after", retryAfter))
+			span.SetStatus(codes.Error, "zipcode lookup rate limited")
+			span.End()
+			return
+		}
+		if errors.Is(err, common.ErrInvalidCEP) { // retorna 422, o código foi recusado antes de chamar a viacep
+			common.WriteJSONError(w, http.StatusUnprocessableEntity, "invalid_zipcode", "invalid zipcode")
+			wh.metrics.invalidZipcodes.Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "invalid zipcode")
+			span.End()
+			return
+		}
+		if errors.Is(err, ErrCEPNotFound) { // retorna o erro 404
+			common.WriteJSONError(w, http.StatusNotFound, "zipcode_not_found", "can not find zipcode")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "can not find zipcode")
+			span.End()
+			return
+		}
+		if errors.Is(err, ErrNonJSONResponse) { // retorna 502 quando a viacep respondeu uma página de erro
+			common.WriteJSONError(w, http.StatusBadGateway, "upstream_error", "zipcode lookup returned non-JSON")
+			wh.metrics.upstreamFailed("viacep")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "zipcode lookup returned non-JSON")
+			span.End()
+			return
+		}
+		if err != nil { // retorna 502 quando a viacep falhou
+			common.WriteJSONError(w, http.StatusBadGateway, "upstream_error", "zipcode lookup failed")
+			if !errors.Is(err, context.Canceled) { // o cliente desistiu, a viacep não falhou
+				wh.metrics.upstreamFailed("viacep")
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "zipcode lookup failed")
+			span.End()
+			return
+		}
+		wh.cityCache.SetContext(ctx, cep, location)
 	}
+	city := location.City
+	span.SetAttributes(attribute.String("city", city), attribute.String("state", location.State))
 	span.End()
 
-	ctx, span = wh.tracer.Start(ctx, "Get City temperature")
+	// a temperatura só vem do cache quando a última leitura é servida
+	ctx, span = wh.tracer.Start(ctx, "Get City temperature",
+		trace.WithAttributes(attribute.Bool("served_from_cache", false)),
+	)
 	defer span.End()
-	tempC, err := wh.apiClient.getTemperatureByCity(city)
-	if err != nil { // retorna 404 caso a cidade do cep não seja encontrada
-		http.Error(w, "can not find temperature", http.StatusNotFound)
+	observation, source, err := wh.apiClient.getTemperatureByCity(ctx, city)
+	retrievedAt, stale := time.Now().UTC(), false
+	if err != nil && !errors.Is(err, context.Canceled) {
+		// com os provedores falhando, responde a última leitura da cidade se ainda for recente
+		if reading, ok := wh.lastReadings.GetContext(ctx, city); ok {
+			span.RecordError(err)
+			span.AddEvent("stale temperature served", trace.WithAttributes(
+				attribute.String("weather.retrieved_at", reading.RetrievedAt.Format(time.RFC3339)),
+				attribute.Float64("weather.age_seconds", time.Since(reading.RetrievedAt).Seconds()),
+			))
+			span.SetAttributes(attribute.Bool("served_from_cache", true))
+			observation = Observation{TempC: reading.TempC, ObservedAt: reading.ObservedAt}
+			source, retrievedAt, stale, err = reading.Source, reading.RetrievedAt, true, nil
+		}
+	}
+	if errors.Is(err, ErrUpstreamBusy) {
+		writeBusy(w, span, err)
+		return
+	}
+	if errors.Is(err, ErrCircuitOpen) { // retorna 503 enquanto nenhum provedor estiver disponível
+		common.WriteJSONError(w, http.StatusServiceUnavailable, "weather_unavailable", "weather service unavailable")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "weather service unavailable")
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) { // retorna 504 quando nenhum provedor respondeu a tempo
+		common.WriteJSONError(w, http.StatusGatewayTimeout, "timeout", "timeout waiting for temperature")
+		recordUpstreamError(span, err, "timeout waiting for temperature")
+		return
+	}
+	if errors.Is(err, ErrCityNotFound) { // retorna 404 caso a cidade do cep não seja encontrada
+		common.WriteJSONError(w, http.StatusNotFound, "temperature_not_found", "can not find temperature")
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "can not find temperature")
 		return
 	}
+	if err != nil { // retorna 502 quando os provedores falharam
+		common.WriteJSONError(w, http.StatusBadGateway, "upstream_error", "temperature lookup failed")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "temperature lookup failed")
+		return
+	}
+
+	tempC := observation.TempC
+	span.SetAttributes(attribute.String("weather.provider", source),
+		attribute.Float64("weather.temp_c", tempC),
+		attribute.Bool("weather.stale", stale),
+	)
 
+	// os caches guardam a temperatura completa, só a resposta é arredondada
+	tempF, tempK := common.ConvertTemperature(tempC)
+	roundedC, roundedF, roundedK := common.Round1(tempC), common.Round1(tempF), common.Round1(tempK)
 	resp := common.WeatherResponse{
-		City:  city,
-		TempC: tempC,
-		TempF: tempC*1.8 + 32,
-		TempK: tempC + 273,
+		Cep:         cep,
+		City:        city,
+		State:       location.State,
+		TempC:       &roundedC,
+		TempF:       &roundedF,
+		TempK:       &roundedK,
+		Source:      source,
+		Stale:       stale,
+		RetrievedAt: retrievedAt,
+	}
+	// a leitura servida do cache já foi validada quando foi guardada
+	if !stale {
+		if err := resp.Validate(wh.bounds); err != nil { // retorna 502 quando o provedor respondeu uma temperatura absurda
+			common.WriteJSONError(w, http.StatusBadGateway, "upstream_error", "implausible temperature from upstream")
+			wh.metrics.upstreamFailed(source)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "implausible temperature from upstream")
+			return
+		}
+		wh.lastReadings.SetContext(ctx, city, temperatureReading{TempC: tempC, Source: source, RetrievedAt: retrievedAt, ObservedAt: observation.ObservedAt})
+	}
+	resp = resp.WithUnits(units)
+	if detail == common.DetailFull {
+		resp.Neighborhood, resp.Street = location.Neighborhood, location.Street
+	}
+	if !observation.ObservedAt.IsZero() {
+		resp.ObservedAt = &observation.ObservedAt
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	span.End()
+	common.EncodeWeather(r.Context(), wh.tracer, w, version, resp)
 }
 
-func (c *ApiClient) getCityByCEP(cep string) (string, error) {
-	resp, err := c.httpGet(fmt.Sprintf("https://viacep.com.br/ws/%s/json/", cep))
+func (c *ApiClient) getCityByCEP(ctx context.Context, cep string) (Location, error) {
+	return c.cityResolver.getCityByCEP(ctx, cep)
+}
+
+// getWithRetry retries network errors and 5xx responses with a jittered
+// exponential backoff, creating a span for each attempt
+func (c *ApiClient) getWithRetry(ctx context.Context, url string) (*http.Response, error) {
+	var resp *http.Response
+	attempts := 0
+	err := common.DoWithRetry(ctx, func(ctx context.Context, attempt int) (bool, error) {
+		attempts = attempt
+		var err error
+		resp, err = c.getAttempt(ctx, url, attempt)
+		return true, err
+	}, c.retryPolicy)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("failed after %d attempts: %w", attempts, err)
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
+	return resp, nil
+}
+
+// writeBusy answers 503 with Retry-After when the upstream concurrency limit
+// was hit, the client can try again shortly
+func writeBusy(w http.ResponseWriter, span trace.Span, err error) {
+	w.Header().Set("Retry-After", "1")
+	common.WriteJSONError(w, http.StatusServiceUnavailable, "upstream_busy", "too many requests in flight, try again")
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
 
-	var viaCEP ViaCEPResponse
-	if err := json.Unmarshal(body, &viaCEP); err != nil {
-		return "", err
+// getAttempt does one ViaCEP call bound to the upstream timeout, the timeout
+// context is only released once the body was read
+func (c *ApiClient) getAttempt(ctx context.Context, url string, attempt int) (*http.Response, error) {
+	attemptCtx, span := c.tracer.Start(ctx, "ViaCEP request attempt",
+		trace.WithAttributes(attribute.Int("http.request.resend_count", attempt-1)),
+	)
+	defer span.End()
+	common.RecordDeadline(ctx, span)
+	attemptCtx, cancel := c.withUpstreamTimeout(attemptCtx)
+	resp, err := get(attemptCtx, c.httpClient, url)
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		resp.Body = cancelOnClose{resp.Body, cancel}
+		return resp, nil
 	}
-	if viaCEP.Erro || viaCEP.Localidade == "" {
-		return "", fmt.Errorf("not found")
+	cancel()
+	if err == nil {
+		resp.Body.Close()
+		err = fmt.Errorf("unexpected status %d", resp.StatusCode)
 	}
-	return viaCEP.Localidade, nil
+	recordUpstreamError(span, err, err.Error())
+	return nil, err
 }
 
-func (c *ApiClient) getTemperatureByCity(city string) (float64, error) {
-	url := fmt.Sprintf("https://api.weatherapi.com/v1/current.json?key=%s&q=%s", c.wheatherApiKey, url.QueryEscape(city))
-	resp, err := c.httpGet(url)
-	if err != nil {
-		return 0, err
+// withUpstreamTimeout bounds a single upstream call, so a slow upstream can't
+// hold the request for the whole budget of the caller
+func (c *ApiClient) withUpstreamTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.upstreamTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.upstreamTimeout)
+}
+
+// cancelOnClose releases the timeout context of a response when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// recordUpstreamError marks the span as failed, flagging the timeouts with
+// error.type so they can be told apart from the upstream errors
+func recordUpstreamError(span trace.Span, err error, message string) {
+	span.RecordError(err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		span.SetAttributes(attribute.String("error.type", "timeout"))
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
+	span.SetStatus(codes.Error, message)
+}
 
-	var weather WeatherAPIResponse
-	if err := json.Unmarshal(body, &weather); err != nil {
-		return 0, err
+// observeProvider records the latency and outcome of a weather provider call
+// under its own name, so a fallback isn't mixed with the first provider. The
+// calls refused by an open circuit never reached the provider.
+func (c *ApiClient) observeProvider(name string, err error, elapsed time.Duration) {
+	if errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	c.metrics.observeUpstream(name, err, elapsed)
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrCityNotFound) {
+		c.metrics.upstreamFailed(name)
+	}
+}
+
+// getTemperatureByCity asks the weather providers in order, falling back to
+// the next one when a provider fails or has its circuit breaker open. The
+// error is ErrCityNotFound only when every provider called reported it.
+func (c *ApiClient) getTemperatureByCity(ctx context.Context, city string) (Observation, string, error) {
+	var errs []error
+	for _, provider := range c.weatherProviders {
+		// service_a gave up or its deadline passed, asking the next provider is useless
+		if err := ctx.Err(); err != nil {
+			return Observation{}, "", err
+		}
+		providerCtx, span := c.tracer.Start(ctx, "Get temperature from "+provider.Name(),
+			trace.WithAttributes(attribute.String("weather.provider", provider.Name())),
+		)
+		common.RecordDeadline(ctx, span)
+		var observation Observation
+		start := time.Now()
+		err := provider.breaker.Execute(func() (err error) {
+			callCtx, cancel := c.withUpstreamTimeout(providerCtx)
+			defer cancel()
+			observation, err = provider.Temperature(callCtx, city)
+			return err
+		})
+		c.observeProvider(provider.Name(), err, time.Since(start))
+		span.SetAttributes(attribute.String("circuit_breaker.state", provider.breaker.State()))
+		if err == nil {
+			span.End()
+			return observation, provider.Name(), nil
+		}
+		recordUpstreamError(span, err, err.Error())
+		span.End()
+		errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+	}
+	if allCircuitsOpen(errs) {
+		return Observation{}, "", ErrCircuitOpen
+	}
+	if !cityNotFoundByAll(errs) {
+		// um provedor que falhou não prova que a cidade não existe, a resposta
+		// é um 502 e não um 404
+		for i, err := range errs {
+			if errors.Is(err, ErrCityNotFound) {
+				errs[i] = errors.New(err.Error())
+			}
+		}
 	}
-	return weather.Current.TempC, nil
+	return Observation{}, "", fmt.Errorf("temperature of city %q: no weather provider answered: %w", city, errors.Join(errs...))
 }
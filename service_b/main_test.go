@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakeApiClient answers the lookups with fixed values instead of calling ViaCEP and the providers
+type fakeApiClient struct {
+	location    Location
+	cityErr     error
+	observation Observation
+	tempErr     error
+}
+
+func (c fakeApiClient) getCityByCEP(ctx context.Context, cep string) (Location, error) {
+	return c.location, c.cityErr
+}
+
+func (c fakeApiClient) getTemperatureByCity(ctx context.Context, city string) (Observation, string, error) {
+	if c.tempErr != nil {
+		return Observation{}, "", c.tempErr
+	}
+	return c.observation, SourceWeatherAPI, nil
+}
+
+// newTestRouter builds the service_b router around client, with a noop tracer
+func newTestRouter(t *testing.T, client IApiClient) http.Handler {
+	t.Helper()
+	postalCodes, err := common.NewPostalCodeValidator(common.CountryBR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	wh := NewWeatherHandler(client,
+		NewMemoryCityCache(time.Minute),
+		NewMemoryTemperatureCache(time.Minute),
+		postalCodes, nil, common.DefaultTemperatureBounds,
+		noop.NewTracerProvider().Tracer("test"),
+		NewMetrics(registry),
+	)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return getRouter(wh, logger, registry, common.HealthHandler, nil)
+}
+
+func TestWeatherHandler(t *testing.T) {
+	found := fakeApiClient{location: Location{City: "São Paulo", State: "SP"}, observation: Observation{TempC: 25}}
+	tests := []struct {
+		name       string
+		client     fakeApiClient
+		cep        string
+		wantStatus int
+		wantCode   string
+	}{
+		{"valid zipcode", found, "01001-000", http.StatusOK, ""},
+		{"invalid zipcode", found, "0100100", http.StatusUnprocessableEntity, "invalid_zipcode"},
+		{"zipcode rejected by the resolver", fakeApiClient{cityErr: common.ErrInvalidCEP}, "01001000", http.StatusUnprocessableEntity, "invalid_zipcode"},
+		{"city not found", fakeApiClient{cityErr: ErrCEPNotFound}, "01001000", http.StatusNotFound, "zipcode_not_found"},
+		{"implausible temperature", fakeApiClient{location: Location{City: "São Paulo"}, observation: Observation{TempC: 298.15}}, "01001000", http.StatusBadGateway, "upstream_error"},
+		{"temperature not found", fakeApiClient{location: Location{City: "Xyz"}, tempErr: ErrCityNotFound}, "01001000", http.StatusNotFound, "temperature_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			newTestRouter(t, tt.client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/weather?cep="+tt.cep, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantCode != "" {
+				var body common.ErrorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Error.Code != tt.wantCode {
+					t.Errorf("code = %q, want %q", body.Error.Code, tt.wantCode)
+				}
+				return
+			}
+
+			var body common.WeatherResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Cep != "01001000" || body.City != "São Paulo" || body.Source != SourceWeatherAPI {
+				t.Errorf("body = %+v, want the normalized cep and the city", body)
+			}
+			if body.TempC == nil || *body.TempC != 25 || body.TempF == nil || *body.TempF != 77 {
+				t.Errorf("temperatures = %v °C %v °F, want 25 °C 77 °F", body.TempC, body.TempF)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Metrics struct {
+	requestDuration  *prometheus.HistogramVec
+	upstreamFailures *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	invalidZipcodes  prometheus.Counter
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "weather_handler_duration_seconds",
+			Help:    "Duration of /weather requests in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"status"}),
+		upstreamFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "weather_upstream_failures_total",
+			Help: "Number of failed calls to the upstream APIs.",
+		}, []string{"upstream"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "weather_upstream_duration_seconds",
+			Help:    "Duration of the calls to the upstream APIs in seconds, retries included.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"upstream", "outcome"}),
+		invalidZipcodes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weather_invalid_zipcode_total",
+			Help: "Number of requests rejected with 422 invalid zipcode.",
+		}),
+	}
+	reg.MustRegister(m.requestDuration, m.upstreamFailures, m.upstreamDuration, m.invalidZipcodes)
+	return m
+}
+
+func (m *Metrics) observeRequest(status int, elapsed time.Duration) {
+	m.requestDuration.WithLabelValues(strconv.Itoa(status)).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) upstreamFailed(upstream string) {
+	m.upstreamFailures.WithLabelValues(upstream).Inc()
+}
+
+func (m *Metrics) observeUpstream(upstream string, err error, elapsed time.Duration) {
+	m.upstreamDuration.WithLabelValues(upstream, upstreamOutcome(err)).Observe(elapsed.Seconds())
+}
+
+// upstreamOutcome is a low cardinality label for the result of an upstream call
+func upstreamOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrCEPNotFound), errors.Is(err, ErrCityNotFound):
+		return "not_found"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, new(*RateLimitedError)):
+		return "rate_limited"
+	default:
+		return "error"
+	}
+}
+
+// instrumentedApiClient records the latency and outcome of the ViaCEP calls
+// of the wrapped client, it must wrap the client directly so the time waiting
+// for the concurrency limiter isn't counted. The weather providers are
+// recorded one by one by ApiClient.getTemperatureByCity.
+type instrumentedApiClient struct {
+	IApiClient
+	metrics *Metrics
+}
+
+func NewInstrumentedClient(client IApiClient, metrics *Metrics) IApiClient {
+	return &instrumentedApiClient{IApiClient: client, metrics: metrics}
+}
+
+func (c *instrumentedApiClient) getCityByCEP(ctx context.Context, cep string) (Location, error) {
+	start := time.Now()
+	location, err := c.IApiClient.getCityByCEP(ctx, cep)
+	if !errors.Is(err, common.ErrInvalidCEP) { // o código recusado não chegou à viacep
+		c.metrics.observeUpstream("viacep", err, time.Since(start))
+	}
+	return location, err
+}
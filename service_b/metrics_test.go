@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type fakeProvider struct {
+	name string
+	err  error
+}
+
+func (p fakeProvider) Name() string { return p.name }
+
+func (p fakeProvider) Temperature(ctx context.Context, city string) (Observation, error) {
+	if p.err != nil {
+		return Observation{}, p.err
+	}
+	return Observation{TempC: 21.5}, nil
+}
+
+// upstreamSeries reads the upstream metrics as upstream/outcome -> count
+func upstreamSeries(t *testing.T, registry *prometheus.Registry) (durations, failures map[string]uint64) {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	durations, failures = map[string]uint64{}, map[string]uint64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			switch family.GetName() {
+			case "weather_upstream_duration_seconds":
+				durations[labels["upstream"]+"/"+labels["outcome"]] = metric.GetHistogram().GetSampleCount()
+			case "weather_upstream_failures_total":
+				failures[labels["upstream"]] = uint64(metric.GetCounter().GetValue())
+			}
+		}
+	}
+	return durations, failures
+}
+
+func TestGetTemperatureByCityRecordsEachProvider(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	client := &ApiClient{
+		weatherProviders: []guardedProvider{
+			{WeatherProvider: fakeProvider{name: SourceWeatherAPI, err: errors.New("connection refused")}, breaker: NewCircuitBreaker(5, time.Minute)},
+			{WeatherProvider: fakeProvider{name: SourceOpenMeteo}, breaker: NewCircuitBreaker(5, time.Minute)},
+		},
+		tracer:          noop.NewTracerProvider().Tracer("test"),
+		upstreamTimeout: time.Second,
+		metrics:         NewMetrics(registry),
+	}
+
+	_, source, err := client.getTemperatureByCity(context.Background(), "Linhares")
+	if err != nil || source != SourceOpenMeteo {
+		t.Fatalf("getTemperatureByCity() = %q, %v, want the fallback to %s", source, err, SourceOpenMeteo)
+	}
+
+	durations, failures := upstreamSeries(t, registry)
+	want := map[string]uint64{SourceWeatherAPI + "/error": 1, SourceOpenMeteo + "/success": 1}
+	if len(durations) != len(want) {
+		t.Errorf("duration series = %v, want %v", durations, want)
+	}
+	for series, count := range want {
+		if durations[series] != count {
+			t.Errorf("duration count of %s = %d, want %d", series, durations[series], count)
+		}
+	}
+	if failures[SourceWeatherAPI] != 1 || failures[SourceOpenMeteo] != 0 {
+		t.Errorf("failures = %v, want only %s", failures, SourceWeatherAPI)
+	}
+}
+
+func TestGetTemperatureByCityNotFound(t *testing.T) {
+	notFound := fmt.Errorf("city %q: %w", "Xyz", ErrCityNotFound)
+	provider := func(name string, err error) guardedProvider {
+		return guardedProvider{WeatherProvider: fakeProvider{name: name, err: err}, breaker: NewCircuitBreaker(5, time.Minute)}
+	}
+	openCircuit := NewCircuitBreaker(1, time.Minute)
+	openCircuit.Execute(func() error { return errors.New("connection refused") })
+
+	tests := []struct {
+		name         string
+		providers    []guardedProvider
+		wantNotFound bool
+	}{
+		{"every provider not found", []guardedProvider{provider(SourceWeatherAPI, notFound), provider(SourceOpenMeteo, notFound)}, true},
+		{"first failed, second not found", []guardedProvider{provider(SourceWeatherAPI, &StatusError{StatusCode: 500}), provider(SourceOpenMeteo, notFound)}, false},
+		{"first not found, second failed", []guardedProvider{provider(SourceWeatherAPI, notFound), provider(SourceOpenMeteo, errors.New("connection refused"))}, false},
+		{"circuit open, second not found", []guardedProvider{{WeatherProvider: fakeProvider{name: SourceWeatherAPI}, breaker: openCircuit}, provider(SourceOpenMeteo, notFound)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &ApiClient{
+				weatherProviders: tt.providers,
+				tracer:           noop.NewTracerProvider().Tracer("test"),
+				upstreamTimeout:  time.Second,
+				metrics:          NewMetrics(prometheus.NewRegistry()),
+			}
+			_, _, err := client.getTemperatureByCity(context.Background(), "Xyz")
+			if err == nil {
+				t.Fatal("getTemperatureByCity() succeeded, want an error")
+			}
+			if got := errors.Is(err, ErrCityNotFound); got != tt.wantNotFound {
+				t.Errorf("errors.Is(%v, ErrCityNotFound) = %v, want %v", err, got, tt.wantNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SourceMock = "mock"
+	// MockCEPNotFound is the CEP the mock client does not find, to exercise the 404
+	MockCEPNotFound = "00000000"
+)
+
+var mockLocations = map[string]Location{
+	"01001000": {City: "São Paulo", State: "SP", Neighborhood: "Sé", Street: "Praça da Sé"},
+	"20040030": {City: "Rio de Janeiro", State: "RJ"},
+	"29902555": {City: "Linhares", State: "ES"},
+}
+
+// mockApiClient answers deterministic fake data instead of calling ViaCEP and
+// the weather providers, for running service_a end to end without api keys.
+// It still creates the upstream spans so the traces look like the real ones.
+type mockApiClient struct {
+	tracer trace.Tracer
+}
+
+func NewMockClient(tracer trace.Tracer) *mockApiClient {
+	return &mockApiClient{tracer: tracer}
+}
+
+func (c *mockApiClient) getCityByCEP(ctx context.Context, cep string) (Location, error) {
+	_, span := c.tracer.Start(ctx, "ViaCEP request attempt",
+		trace.WithAttributes(attribute.Bool("mock", true)),
+	)
+	defer span.End()
+	if cep == MockCEPNotFound {
+		err := fmt.Errorf("mock lookup of cep %s: %w", cep, ErrCEPNotFound)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return Location{}, err
+	}
+	if location, ok := mockLocations[cep]; ok {
+		return location, nil
+	}
+	return Location{City: "Cidade " + cep[:5], State: "SP"}, nil
+}
+
+func (c *mockApiClient) getTemperatureByCity(ctx context.Context, city string) (Observation, string, error) {
+	_, span := c.tracer.Start(ctx, "Get temperature from "+SourceMock,
+		trace.WithAttributes(attribute.String("weather.provider", SourceMock), attribute.Bool("mock", true)),
+	)
+	defer span.End()
+
+	// a mesma cidade sempre tem a mesma temperatura, entre 10 e 35 graus
+	h := fnv.New32a()
+	h.Write([]byte(city))
+	return Observation{TempC: 10 + float64(h.Sum32()%250)/10}, SourceMock, nil
+}
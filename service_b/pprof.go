@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// newPprofServer serves the net/http/pprof handlers on their own address,
+// away from the traced router so profiling doesn't show up in the traces
+func newPprofServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func startPprof(logger *slog.Logger, srv *http.Server) {
+	go func() {
+		logger.Warn("pprof enabled", slog.String("addr", srv.Addr))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("pprof server failed", slog.Any("error", err))
+		}
+	}()
+}
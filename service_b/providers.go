@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+)
+
+const (
+	SourceWeatherAPI = "weatherapi"
+	SourceOpenMeteo  = "openmeteo"
+)
+
+// ErrCityNotFound is returned by the providers that don't know the city
+var ErrCityNotFound = errors.New("city not found")
+
+// Observation is a temperature read from a provider
+type Observation struct {
+	TempC float64
+	// ObservedAt is when the provider measured it, zero when it doesn't tell
+	ObservedAt time.Time
+}
+
+// WeatherProvider is an upstream API able to tell the current temperature of a city
+type WeatherProvider interface {
+	Name() string
+	Temperature(ctx context.Context, city string) (Observation, error)
+}
+
+// guardedProvider is a provider with its own circuit breaker, so a provider
+// that is down is skipped without waiting for its timeout
+type guardedProvider struct {
+	WeatherProvider
+	breaker *CircuitBreaker
+}
+
+// NewWeatherProviders builds the providers in the given order, like
+// "weatherapi,openmeteo", each one guarded by a circuit breaker built by newBreaker
+func NewWeatherProviders(
+	order string,
+	httpClient *http.Client,
+	weatherApiBaseURL string,
+	weatherApiKey string,
+	newBreaker func() *CircuitBreaker,
+) ([]guardedProvider, error) {
+	var providers []guardedProvider
+	for _, name := range strings.Split(order, ",") {
+		var provider WeatherProvider
+		switch strings.TrimSpace(name) {
+		case SourceWeatherAPI:
+			provider = &weatherAPIProvider{
+				httpClient: httpClient,
+				baseURL:    strings.TrimSuffix(weatherApiBaseURL, "/"),
+				apiKey:     weatherApiKey,
+			}
+		case SourceOpenMeteo:
+			provider = &openMeteoProvider{httpClient: httpClient}
+		default:
+			return nil, fmt.Errorf("unknown weather provider %q", name)
+		}
+		providers = append(providers, guardedProvider{WeatherProvider: provider, breaker: newBreaker()})
+	}
+	return providers, nil
+}
+
+type WeatherAPIResponse struct {
+	Current *struct {
+		TempC            *float64 `json:"temp_c"`
+		LastUpdatedEpoch int64    `json:"last_updated_epoch"`
+	} `json:"current"`
+	Error *WeatherAPIError `json:"error"`
+}
+
+// WeatherAPIError is the body returned by the weatherapi on failures, like
+// {"error": {"code": 1006, "message": "No matching location found."}}
+type WeatherAPIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Status is the HTTP status of the response that carried the error
+	Status int `json:"-"`
+}
+
+// StatusError is an upstream answer with an unexpected HTTP status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.StatusCode)
+}
+
+// weatherAPINoLocationFound is the weatherapi error code for an unknown city
+const weatherAPINoLocationFound = 1006
+
+func (e *WeatherAPIError) Error() string {
+	return fmt.Sprintf("weatherapi error %d: %s", e.Code, e.Message)
+}
+
+type weatherAPIProvider struct {
+	httpClient *http.Client
+	baseURL    string
+	apiKey     string
+}
+
+func (p *weatherAPIProvider) Name() string {
+	return SourceWeatherAPI
+}
+
+func (p *weatherAPIProvider) Temperature(ctx context.Context, city string) (Observation, error) {
+	resp, err := get(ctx, p.httpClient, fmt.Sprintf("%s/v1/current.json?key=%s&q=%s", p.baseURL, p.apiKey, url.QueryEscape(city)))
+	if err != nil { // o erro do net/http contém a url com a chave da weatherapi
+		return Observation{}, fmt.Errorf("city %q: %w", city, common.RedactError(err))
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var weather WeatherAPIResponse
+	if err := json.Unmarshal(body, &weather); err != nil {
+		return Observation{}, fmt.Errorf("city %q: decoding status %d response: %w", city, resp.StatusCode, err)
+	}
+	if weather.Error != nil {
+		weather.Error.Status = resp.StatusCode
+	}
+	if weather.Error != nil && weather.Error.Code == weatherAPINoLocationFound {
+		return Observation{}, fmt.Errorf("city %q: %w: %w", city, ErrCityNotFound, weather.Error)
+	}
+	if weather.Error != nil {
+		return Observation{}, fmt.Errorf("city %q: %w", city, weather.Error)
+	}
+	// sem a temperatura na resposta não há leitura, em vez de assumir 0
+	if weather.Current == nil || weather.Current.TempC == nil {
+		return Observation{}, fmt.Errorf("weatherapi response without current temperature")
+	}
+	observation := Observation{TempC: *weather.Current.TempC}
+	if weather.Current.LastUpdatedEpoch > 0 {
+		observation.ObservedAt = time.Unix(weather.Current.LastUpdatedEpoch, 0).UTC()
+	}
+	return observation, nil
+}
+
+type OpenMeteoGeocodingResponse struct {
+	Results []struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	} `json:"results"`
+}
+
+type OpenMeteoForecastResponse struct {
+	Current *struct {
+		Temperature *float64 `json:"temperature_2m"`
+	} `json:"current"`
+}
+
+// openMeteoProvider needs coordinates, so the city is geocoded by the
+// open-meteo geocoding API before asking for the forecast
+type openMeteoProvider struct {
+	httpClient *http.Client
+}
+
+func (p *openMeteoProvider) Name() string {
+	return SourceOpenMeteo
+}
+
+func (p *openMeteoProvider) Temperature(ctx context.Context, city string) (Observation, error) {
+	var geocoding OpenMeteoGeocodingResponse
+	err := getJSON(ctx, p.httpClient, fmt.Sprintf("https://geocoding-api.open-meteo.com/v1/search?name=%s&count=1&countryCode=BR", url.QueryEscape(city)), &geocoding)
+	if err != nil {
+		return Observation{}, fmt.Errorf("geocoding city %q: %w", city, err)
+	}
+	if len(geocoding.Results) == 0 {
+		return Observation{}, fmt.Errorf("geocoding city %q: %w", city, ErrCityNotFound)
+	}
+
+	var forecast OpenMeteoForecastResponse
+	err = getJSON(ctx, p.httpClient, fmt.Sprintf("https://api.open-meteo.com/v1/forecast?latitude=%f&longitude=%f&current=temperature_2m", geocoding.Results[0].Latitude, geocoding.Results[0].Longitude), &forecast)
+	if err != nil {
+		return Observation{}, fmt.Errorf("forecast of city %q: %w", city, err)
+	}
+	if forecast.Current == nil || forecast.Current.Temperature == nil {
+		return Observation{}, fmt.Errorf("open-meteo response without current temperature")
+	}
+	return Observation{TempC: *forecast.Current.Temperature}, nil
+}
+
+// get does a GET bound to ctx, so the otelhttp client span is nested under
+// the span in ctx
+func get(ctx context.Context, httpClient *http.Client, url string) (*http.Response, error) {
+	common.LoggerFromContext(ctx).Debug("upstream request", slog.String("url", common.RedactURL(url)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+func getJSON(ctx context.Context, httpClient *http.Client, url string, v any) error {
+	resp, err := get(ctx, httpClient, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// allCircuitsOpen tells whether every provider was skipped by its breaker,
+// which means the temperature is unavailable rather than not found
+func allCircuitsOpen(errs []error) bool {
+	for _, err := range errs {
+		if !errors.Is(err, ErrCircuitOpen) {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
+
+// cityNotFoundByAll tells whether every provider called, not the ones skipped
+// by their breaker, reported the city as not found
+func cityNotFoundByAll(errs []error) bool {
+	called := 0
+	for _, err := range errs {
+		if errors.Is(err, ErrCircuitOpen) {
+			continue
+		}
+		if !errors.Is(err, ErrCityNotFound) {
+			return false
+		}
+		called++
+	}
+	return called > 0
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+)
+
+const readinessGateInterval = 2 * time.Second
+
+// readinessGate keeps /ready failing until the first successful check of the
+// upstreams: ViaCEP answers and the weatherapi accepts the key
+type readinessGate struct {
+	open              atomic.Bool
+	client            *http.Client
+	viaCEPBaseURL     string
+	weatherAPIBaseURL string
+	apiKey            string
+}
+
+func newReadinessGate(client *http.Client, viaCEPBaseURL, weatherAPIBaseURL, apiKey string) *readinessGate {
+	return &readinessGate{
+		client:            client,
+		viaCEPBaseURL:     strings.TrimSuffix(viaCEPBaseURL, "/"),
+		weatherAPIBaseURL: strings.TrimSuffix(weatherAPIBaseURL, "/"),
+		apiKey:            apiKey,
+	}
+}
+
+func (g *readinessGate) Open() bool {
+	return g.open.Load()
+}
+
+// run checks the upstreams until they answer, then opens the gate. After the
+// timeout the gate is opened anyway with a warning, so a flaky upstream at
+// startup doesn't keep the service out of the load balancer forever.
+func (g *readinessGate) run(ctx context.Context, logger *slog.Logger, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for {
+		err := g.check(ctx)
+		if err == nil {
+			logger.Info("upstream check succeeded, service ready")
+			g.open.Store(true)
+			return
+		}
+		logger.Debug("upstream check failed, retrying", slog.Any("error", err))
+		select {
+		case <-time.After(readinessGateInterval):
+		case <-deadline:
+			logger.Warn("upstream check did not succeed in time, marking the service ready anyway",
+				slog.Duration("timeout", timeout),
+				slog.Any("error", err),
+			)
+			g.open.Store(true)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *readinessGate) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := common.CheckReachable(ctx, g.client, g.viaCEPBaseURL+"/ws/01001000/json/"); err != nil {
+		return fmt.Errorf("viacep: %w", err)
+	}
+
+	// uma consulta barata, só para validar a chave
+	url := fmt.Sprintf("%s/v1/current.json?key=%s&q=London", g.weatherAPIBaseURL, g.apiKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return common.RedactError(err)
+	}
+	res, err := g.client.Do(req)
+	if err != nil { // o erro do net/http contém a url com a chave da weatherapi
+		return fmt.Errorf("weatherapi: %w", common.RedactError(err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("weatherapi: unexpected status %d, is the key valid?", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const PostalProviderViaCEP = "viacep"
+
+// CityResolver is a postal API able to tell the city of a postal code, each
+// implementation decodes the JSON shape of its own API
+type CityResolver interface {
+	getCityByCEP(ctx context.Context, code string) (Location, error)
+}
+
+// getFunc does a GET to the upstream, like ApiClient.getWithRetry
+type getFunc func(ctx context.Context, url string) (*http.Response, error)
+
+// newCityResolver builds the resolver of the postal provider, like "viacep",
+// that answers on baseURL. postalCodes is the validator of the configured
+// country, only the codes it accepts go into the lookup URL.
+func newCityResolver(provider string, baseURL string, postalCodes common.PostalCodeValidator, get getFunc) (CityResolver, error) {
+	switch strings.TrimSpace(provider) {
+	case PostalProviderViaCEP:
+		return &viaCEPResolver{baseURL: strings.TrimSuffix(baseURL, "/"), postalCodes: postalCodes, get: get}, nil
+	default:
+		return nil, fmt.Errorf("unknown postal provider %q", provider)
+	}
+}
+
+// ErrNonJSONResponse is returned when the postal API answers something else
+// than JSON, like the HTML error page ViaCEP serves with a 200 during outages
+var ErrNonJSONResponse = errors.New("upstream returned non-JSON")
+
+// maxBodyPreview bounds the body recorded on the span when it isn't JSON
+const maxBodyPreview = 200
+
+// defaultRateLimitRetryAfter is the Retry-After answered when the postal API
+// rate limited us without telling when to retry
+const defaultRateLimitRetryAfter = "60"
+
+// RateLimitedError is returned when the postal API answers 429 Too Many
+// Requests, RetryAfter is its Retry-After header, empty when it doesn't tell
+type RateLimitedError struct {
+	RetryAfter string
+}
+
+func (e *RateLimitedError) Error() string {
+	return "rate limited by the postal api"
+}
+
+type ViaCEPResponse struct {
+	Logradouro string `json:"logradouro,omitempty"`
+	Bairro     string `json:"bairro,omitempty"`
+	Localidade string `json:"localidade,omitempty"`
+	Uf         string `json:"uf,omitempty"`
+	Erro       bool   `json:"erro,omitempty"`
+}
+
+type viaCEPResolver struct {
+	baseURL     string
+	postalCodes common.PostalCodeValidator
+	get         getFunc
+}
+
+func (r *viaCEPResolver) getCityByCEP(ctx context.Context, cep string) (Location, error) {
+	// o handler já valida o cep, mas só um código normalizado pode entrar no path da url
+	if !r.postalCodes.IsValid(cep) {
+		return Location{}, fmt.Errorf("viacep lookup of cep %q: %w", cep, common.ErrInvalidCEP)
+	}
+	resp, err := r.get(ctx, fmt.Sprintf("%s/ws/%s/json/", r.baseURL, cep))
+	if err != nil {
+		return Location{}, fmt.Errorf("viacep lookup of cep %s: %w", cep, err)
+	}
+	defer resp.Body.Close()
+	// o 429 não é um cep inexistente, a viacep recusou a consulta
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return Location{}, fmt.Errorf("viacep lookup of cep %s: %w", cep, &RateLimitedError{RetryAfter: resp.Header.Get("Retry-After")})
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !looksLikeJSON(resp.Header.Get("Content-Type"), body) {
+		preview := body[:min(len(body), maxBodyPreview)]
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("http.response.content_type", resp.Header.Get("Content-Type")),
+			attribute.String("http.response.body.preview", strings.ToValidUTF8(string(preview), "?")),
+		)
+		return Location{}, fmt.Errorf("viacep lookup of cep %s: status %d: %w", cep, resp.StatusCode, ErrNonJSONResponse)
+	}
+
+	var viaCEP ViaCEPResponse
+	if err := json.Unmarshal(body, &viaCEP); err != nil {
+		return Location{}, fmt.Errorf("viacep lookup of cep %s: decoding status %d response: %w", cep, resp.StatusCode, err)
+	}
+	if viaCEP.Erro || viaCEP.Localidade == "" {
+		return Location{}, fmt.Errorf("viacep lookup of cep %s: %w", cep, ErrCEPNotFound)
+	}
+	return Location{
+		City:         viaCEP.Localidade,
+		State:        viaCEP.Uf,
+		Neighborhood: viaCEP.Bairro,
+		Street:       viaCEP.Logradouro,
+	}, nil
+}
+
+// looksLikeJSON rejects the bodies declared as another media type, or that
+// start like markup when the content type is missing
+func looksLikeJSON(contentType string, body []byte) bool {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return false
+		}
+	}
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) == 0 || trimmed[0] != '<'
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mobenaus/fc-pos-go-labs-observabilidade/common"
+)
+
+func TestViaCEPResolverRejectsUnsafeCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		country string
+		code    string
+		wantURL string
+	}{
+		{"path traversal", common.CountryBR, "../../etc", ""},
+		{"encoded traversal", common.CountryBR, "..%2F..%2Fetc", ""},
+		{"query injection", common.CountryBR, "01001000?x=1", ""},
+		{"not normalized", common.CountryBR, "01001-000", ""},
+		{"br cep", common.CountryBR, "01001000", "https://viacep.test/ws/01001000/json/"},
+		{"pt code", common.CountryPT, "1000-001", "https://viacep.test/ws/1000-001/json/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postalCodes, err := common.NewPostalCodeValidator(tt.country)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var requested []string
+			resolver, err := newCityResolver(PostalProviderViaCEP, "https://viacep.test/", postalCodes, func(ctx context.Context, url string) (*http.Response, error) {
+				requested = append(requested, url)
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       io.NopCloser(strings.NewReader(`{"localidade":"São Paulo","uf":"SP"}`)),
+				}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = resolver.getCityByCEP(context.Background(), tt.code)
+			if tt.wantURL == "" {
+				if !errors.Is(err, common.ErrInvalidCEP) {
+					t.Errorf("getCityByCEP(%q) error = %v, want ErrInvalidCEP", tt.code, err)
+				}
+				if len(requested) > 0 {
+					t.Errorf("getCityByCEP(%q) requested %v, want no request", tt.code, requested)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getCityByCEP(%q) error = %v", tt.code, err)
+			}
+			if len(requested) != 1 || requested[0] != tt.wantURL {
+				t.Errorf("getCityByCEP(%q) requested %v, want %s", tt.code, requested, tt.wantURL)
+			}
+		})
+	}
+}